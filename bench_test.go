@@ -0,0 +1,70 @@
+package milter
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net/textproto"
+	"testing"
+)
+
+// discardSock reads from a fixed input and discards all writes
+type discardSock struct {
+	in io.Reader
+}
+
+func (d *discardSock) Read(p []byte) (int, error)  { return d.in.Read(p) }
+func (d *discardSock) Write(p []byte) (int, error) { return len(p), nil }
+func (d *discardSock) Close() error                { return nil }
+
+func BenchmarkWritePacket(b *testing.B) {
+	session := &milterSession{sock: &discardSock{}}
+	msg := &Message{'h', []byte("X-Spam-Score\x000.1\x00")}
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if err := session.WritePacket(msg); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkHeaderHeavyMessage processes a message with many headers, the milter
+// adds a header for each of them
+func BenchmarkHeaderHeavyMessage(b *testing.B) {
+	var input bytes.Buffer
+	packet := func(code byte, data []byte) {
+		binary.Write(&input, binary.BigEndian, uint32(len(data)+1))
+		input.WriteByte(code)
+		input.Write(data)
+	}
+	packet('O', optneg(6, OptAllActions, 0))
+	packet('M', cstrings("<from@example.com>"))
+	packet('R', cstrings("<to@example.com>"))
+	for i := 0; i < 100; i++ {
+		packet('L', cstrings("Received", "from mx.example.com by mx.example.org"))
+	}
+	packet('N', nil)
+	packet('B', []byte("body\r\n"))
+	packet('E', nil)
+	packet('Q', nil)
+
+	milter := &hookMilter{
+		header: func(name string, value string, m *Modifier) (Response, error) {
+			return RespContinue, m.AddHeader("X-Checked", name)
+		},
+		headers: func(h textproto.MIMEHeader, m *Modifier) (Response, error) {
+			return RespContinue, nil
+		},
+	}
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		milter.calls = milter.calls[:0]
+		session := &milterSession{
+			actions: OptAddHeader,
+			sock:    &discardSock{bytes.NewReader(input.Bytes())},
+			milter:  milter,
+			logger:  &testLogger{},
+		}
+		session.HandleMilterCommands()
+	}
+}
@@ -0,0 +1,50 @@
+package milter
+
+import (
+	"bytes"
+)
+
+// maxBodyLine is the longest line passed to a lineWriter's fn, longer lines are
+// delivered in pieces of this size so a body without line breaks is not buffered whole
+const maxBodyLine = 64 * 1024
+
+// lineWriter is an io.Writer that calls fn for every complete line written to it
+type lineWriter struct {
+	fn      func(line []byte)
+	partial []byte
+}
+
+// Write splits p into lines, a trailing partial line is kept until it is completed
+// or reaches maxBodyLine
+func (w *lineWriter) Write(p []byte) (int, error) {
+	n := len(p)
+	for len(p) > 0 {
+		end := bytes.IndexByte(p, '\n') + 1
+		complete := end > 0
+		if !complete {
+			end = len(p)
+		}
+		if room := maxBodyLine - len(w.partial); end >= room {
+			end, complete = room, true
+		}
+		if complete && len(w.partial) == 0 {
+			w.fn(p[:end])
+		} else {
+			w.partial = append(w.partial, p[:end]...)
+			if complete {
+				w.fn(w.partial)
+				w.partial = w.partial[:0]
+			}
+		}
+		p = p[end:]
+	}
+	return n, nil
+}
+
+// Flush passes a remaining unterminated line to fn
+func (w *lineWriter) Flush() {
+	if len(w.partial) > 0 {
+		w.fn(w.partial)
+		w.partial = w.partial[:0]
+	}
+}
@@ -8,12 +8,45 @@ import (
 // NULL terminator
 const null = "\x00"
 
-// DecodeCStrings splits a C style strings into a Go slice
+// maxCStrings limits the strings decoded from a packet, anything following them is
+// dropped so that a packet of NULs can not cause millions of allocations
+const maxCStrings = 1024
+
+// splitCStrings splits s at NULs into at most maxCStrings strings
+func splitCStrings(s string) []string {
+	values := strings.SplitN(s, null, maxCStrings+1)
+	if len(values) > maxCStrings {
+		values = values[:maxCStrings]
+	}
+	return values
+}
+
+// DecodeCStrings splits a C style strings into a Go slice, a missing terminator of
+// the last string is tolerated
 func decodeCStrings(data []byte) []string {
 	if len(data) == 0 {
 		return nil
 	}
-	return strings.Split(strings.Trim(string(data), null), null)
+	return splitCStrings(strings.Trim(string(data), null))
+}
+
+// encodeCStrings joins values into consecutive C style strings
+func encodeCStrings(values ...string) []byte {
+	var data []byte
+	for _, v := range values {
+		data = append(data, v...)
+		data = append(data, 0)
+	}
+	return data
+}
+
+// decodeMacros splits SMFIC_MACRO data into alternating names and values, unlike
+// decodeCStrings it keeps empty values
+func decodeMacros(data []byte) []string {
+	if len(data) == 0 {
+		return nil
+	}
+	return splitCStrings(strings.TrimSuffix(string(data), null))
 }
 
 // ReadCString reads and returns a C style string from []byte
@@ -24,3 +57,19 @@ func readCString(data []byte) string {
 	}
 	return string(data[0:pos])
 }
+
+// decodeEnvelope splits SMFIC_MAIL/SMFIC_RCPT data into the address and ESMTP arguments
+func decodeEnvelope(data []byte) (string, []string) {
+	addr := readCString(data)
+	if len(addr) >= len(data) {
+		return addr, nil
+	}
+	var args []string
+	for _, arg := range decodeCStrings(data[len(addr)+1:]) {
+		// skip empty strings some clients pad the data with
+		if arg != "" {
+			args = append(args, arg)
+		}
+	}
+	return addr, args
+}
@@ -0,0 +1,44 @@
+//go:build go1.18
+// +build go1.18
+
+package milter
+
+import (
+	"testing"
+)
+
+func FuzzDecodeCStrings(f *testing.F) {
+	f.Add([]byte("{auth_authen}\x00user\x00i\x00\x00"))
+	f.Add([]byte("<from@example.com>\x00SIZE=1024\x00\x00"))
+	f.Add([]byte("\x00"))
+	f.Fuzz(func(t *testing.T, data []byte) {
+		for _, values := range [][]string{decodeCStrings(data), decodeMacros(data)} {
+			if len(values) > maxCStrings {
+				t.Errorf("Got %d strings", len(values))
+			}
+			size := 0
+			for _, v := range values {
+				size += len(v)
+			}
+			if size > len(data) {
+				t.Errorf("Got %d bytes of strings from %d bytes", size, len(data))
+			}
+		}
+		_, args := decodeEnvelope(data)
+		if len(args) > maxCStrings {
+			t.Errorf("Got %d arguments", len(args))
+		}
+		readCString(data)
+	})
+}
+
+func FuzzProcess(f *testing.F) {
+	for _, code := range []byte("ABCDEHKLMNOQRTU") {
+		f.Add(code, []byte{})
+		f.Add(code, []byte("C\x00a\x00"))
+	}
+	f.Fuzz(func(t *testing.T, code byte, data []byte) {
+		session, _, _ := newTestSession(&hookMilter{}, OptAllActions, 0)
+		session.Process(&Message{code, data})
+	})
+}
@@ -0,0 +1,43 @@
+package milter
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestDecodeCStrings(t *testing.T) {
+	tests := []struct {
+		data     string
+		strings  []string
+		macros   []string
+		envelope []string
+	}{
+		{"", nil, nil, []string{""}},
+		{"a\x00b\x00", []string{"a", "b"}, []string{"a", "b"}, []string{"a", "b"}},
+		{"a\x00b", []string{"a", "b"}, []string{"a", "b"}, []string{"a", "b"}},
+		{"a\x00\x00", []string{"a"}, []string{"a", ""}, []string{"a"}},
+		{"\x00\x00\x00", []string{""}, []string{"", "", ""}, []string{""}},
+	}
+	for _, test := range tests {
+		if values := decodeCStrings([]byte(test.data)); !reflect.DeepEqual(values, test.strings) {
+			t.Errorf("%q: decodeCStrings got %q, expected %q", test.data, values, test.strings)
+		}
+		if values := decodeMacros([]byte(test.data)); !reflect.DeepEqual(values, test.macros) {
+			t.Errorf("%q: decodeMacros got %q, expected %q", test.data, values, test.macros)
+		}
+		addr, args := decodeEnvelope([]byte(test.data))
+		if values := append([]string{addr}, args...); !reflect.DeepEqual(values, test.envelope) {
+			t.Errorf("%q: decodeEnvelope got %q, expected %q", test.data, values, test.envelope)
+		}
+	}
+
+	// packets of tiny strings are cut short
+	data := []byte(strings.Repeat("a\x00", 100000))
+	if values := decodeCStrings(data); len(values) != maxCStrings {
+		t.Errorf("Expected %d strings, got %d", maxCStrings, len(values))
+	}
+	if values := decodeMacros(data); len(values) != maxCStrings {
+		t.Errorf("Expected %d macros, got %d", maxCStrings, len(values))
+	}
+}
@@ -0,0 +1,77 @@
+package milter
+
+import (
+	"net"
+)
+
+// Envelope describes the SMTP transaction of the current message
+type Envelope struct {
+	// connection information as passed to Connect
+	Host   string
+	Family string
+	Port   uint16
+	Addr   net.IP
+	// SocketPath is set instead of Addr for unix socket connections
+	SocketPath string
+
+	// ClientPTR and ClientResolve as returned by the Modifier methods
+	ClientPTR     string
+	ClientResolve string
+
+	// Helo is the last HELO/EHLO name
+	Helo string
+
+	// Sender and Recipients as returned by Modifier.Sender and Modifier.Recipients
+	Sender     string
+	Recipients []string
+
+	// QueueID is the MTA queue ID from the "i" macro, if it was sent
+	QueueID string
+
+	// Macros is a copy of all macros defined so far
+	Macros map[string]string
+}
+
+// AuthInfo describes the SMTP AUTH of the client as sent in the auth macros, fields
+// are empty if the macro was not sent
+type AuthInfo struct {
+	Type   string // {auth_type} SASL mechanism, e.g. PLAIN
+	Authen string // {auth_authen} authenticated user
+	SSF    string // {auth_ssf} key length of the SASL security layer
+	Author string // {auth_author} user of the AUTH= parameter of MAIL FROM
+}
+
+// AuthInfo returns the SMTP AUTH details of the session, they are complete from
+// MailFrom on
+func (m *Modifier) AuthInfo() AuthInfo {
+	var info AuthInfo
+	info.Type, _ = m.Macro("auth_type")
+	info.Authen, _ = m.Macro("auth_authen")
+	info.SSF, _ = m.Macro("auth_ssf")
+	info.Author, _ = m.Macro("auth_author")
+	return info
+}
+
+// Envelope returns the transaction details collected so far, it is complete in Body
+func (m *Modifier) Envelope() *Envelope {
+	s := m.session
+	macros := make(map[string]string, len(s.macros))
+	for k, v := range s.macros {
+		macros[k] = v
+	}
+	return &Envelope{
+		Host:       s.host,
+		Family:     s.family,
+		Port:       s.port,
+		Addr:       s.addr,
+		SocketPath: s.socketPath,
+		Helo:       s.helo,
+		Sender:     s.sender,
+		Recipients: m.Recipients(),
+		QueueID:    macros["i"],
+		Macros:     macros,
+
+		ClientPTR:     m.ClientPTR(),
+		ClientResolve: m.ClientResolve(),
+	}
+}
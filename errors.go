@@ -2,10 +2,45 @@ package milter
 
 import (
 	"errors"
+	"fmt"
 )
 
 // pre-defined errors
 var (
 	ErrCloseSession = errors.New("Stop current milter processing")
 	ErrMacroNoData  = errors.New("Macro definition with no data")
+	ErrNilMilter    = errors.New("Milter is nil")
+
+	// protocol errors
+	ErrPacketTooLarge = errors.New("Packet exceeds maximum data size")
+	ErrPacketEmpty    = errors.New("Packet without command code")
+
+	// modification errors
+	ErrActionNotNegotiated = errors.New("Action was not negotiated with the MTA")
+	ErrInvalidAddress      = errors.New("Invalid envelope address")
+	ErrNotNegotiating      = errors.New("Only allowed during option negotiation")
+	ErrInvalidSymListStage = errors.New("Invalid macro list stage")
+	ErrBodyNotBuffered     = errors.New("Message body is not buffered")
+	ErrInvalidHeader       = errors.New("Invalid header name or value")
+	ErrInvalidHeaderIndex  = errors.New("Invalid header index")
+	ErrModifierExpired     = errors.New("Modifier used after its callback returned")
+
+	// response errors
+	ErrInvalidReplyCode = errors.New("Reply code is not a valid 4xx or 5xx code")
+
+	// negotiation errors
+	ErrNegotiationVersion   = errors.New("Unsupported milter protocol version")
+	ErrNegotiationMalformed = errors.New("Malformed option negotiation packet")
+	ErrNegotiationRequired  = errors.New("MTA does not offer required options")
 )
+
+// ProtocolError is returned for commands the MTA sent in violation of the milter
+// protocol, the session is closed
+type ProtocolError struct {
+	Code        byte
+	Description string
+}
+
+func (e *ProtocolError) Error() string {
+	return fmt.Sprintf("Malformed %c command: %s", e.Code, e.Description)
+}
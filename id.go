@@ -0,0 +1,34 @@
+package milter
+
+import (
+	"crypto/rand"
+)
+
+// idAlphabet has no vowels so that IDs do not spell words
+const idAlphabet = "BCDFGHJKLMNPQRSTVWXZ"
+
+// RandomID returns an unguessable ID of length consonants read from crypto/rand, e.g.
+// for Server.NewSessionID and Server.NewMessageID
+//
+//	server.NewMessageID = func() string { return milter.RandomID(12) }
+func RandomID(length int) string {
+	id := make([]byte, 0, length)
+	buf := make([]byte, length)
+	for len(id) < length {
+		if _, err := rand.Read(buf); err != nil {
+			panic("milter: reading random bytes failed: " + err.Error())
+		}
+		for _, b := range buf {
+			// drop bytes above the largest multiple of the alphabet size so that
+			// every letter is equally likely
+			if int(b) >= 256-256%len(idAlphabet) {
+				continue
+			}
+			id = append(id, idAlphabet[int(b)%len(idAlphabet)])
+			if len(id) == length {
+				break
+			}
+		}
+	}
+	return string(id)
+}
@@ -0,0 +1,23 @@
+package milter
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestRandomID(t *testing.T) {
+	seen := map[string]bool{}
+	for i := 0; i < 100; i++ {
+		id := RandomID(12)
+		if len(id) != 12 || strings.Trim(id, idAlphabet) != "" {
+			t.Fatalf("Got invalid ID %q", id)
+		}
+		if seen[id] {
+			t.Fatalf("Got ID %q twice", id)
+		}
+		seen[id] = true
+	}
+	if id := RandomID(0); id != "" {
+		t.Errorf("Expected empty ID, got %q", id)
+	}
+}
@@ -3,34 +3,51 @@ package milter
 import (
 	"net"
 	"net/textproto"
+	"reflect"
+	"strings"
 )
 
-// Milter is an interface for milter callback handlers
+// Milter is an interface for milter callback handlers. Implementations can have
+// the compiler check for missing methods with
+//
+//	var _ milter.Milter = (*MyFilter)(nil)
 type Milter interface {
 	// Called when milter session is created
 	NewSession(logger Logger)
 
-	// Connect is called to provide SMTP connection data for incoming message
+	// Connect is called to provide SMTP connection data for incoming message,
+	// family is "tcp4", "tcp6", "unix" or "unknown". Unknown connections such as
+	// mail submitted locally have port 0 and a nil addr, unix sockets have a nil
+	// addr too, see Modifier.SocketPath
 	//   supress with NoConnect
 	Connect(host string, family string, port uint16, addr net.IP, m *Modifier) (Response, error)
 
-	// Called when we have a new message, can occur more than once per session
+	// Called when we have a new message, can occur more than once per session.
+	// It is called for SMFIC_MAIL right before MailFrom
 	NewMessage()
 
-	// Called when we get RSET, usually an appopriate time to invaliate message-specific state
+	// Called when we get RSET, usually an appopriate time to invaliate message-specific state.
+	// It is called for SMFIC_ABORT, after Abort of an AbortMilter, a message ending
+	// with Body is not followed by Reset unless the MTA aborts it
 	Reset()
 
 	// Helo is called to process any HELO/EHLO related filters
 	//   supress with NoHelo
 	Helo(name string, m *Modifier) (Response, error)
 
-	// MailFrom is called to process filters on envelope FROM address
+	// MailFrom is called to process filters on envelope FROM address, esmtpArgs holds
+	// the ESMTP parameters of the command such as SIZE=10240
 	//   supress with NoMailForm
-	MailFrom(from string, m *Modifier) (Response, error)
+	MailFrom(from string, esmtpArgs []string, m *Modifier) (Response, error)
 
-	// RcptTo is called to process filters on envelope TO address
+	// RcptTo is called to process filters on envelope TO address, esmtpArgs holds
+	// the ESMTP parameters of the command such as NOTIFY=NEVER
 	//   supress with NoRcptTo
-	RcptTo(rcptTo string, m *Modifier) (Response, error)
+	// The protocol has no way to stop the MTA sending further recipients and
+	// RespAccept skips all remaining callbacks of the message, to decide on all
+	// recipients at once return RespContinue and use Modifier.Recipients in Body,
+	// Modifier.RecipientMacros keeps the macros sent with each of them
+	RcptTo(rcptTo string, esmtpArgs []string, m *Modifier) (Response, error)
 
 	// Header is called once for each header in incoming message
 	//   supress with NoHeaders
@@ -40,7 +57,8 @@ type Milter interface {
 	//   supress with NoHeaders
 	Headers(h textproto.MIMEHeader, m *Modifier) (Response, error)
 
-	// BodyChunk is called to process next message body chunk data (up to 64KB in size)
+	// BodyChunk is called to process next message body chunk data (up to 64KB in size),
+	// chunks are never empty unless Server.DeliverEmptyChunks is set
 	//   supress with NoBody
 	BodyChunk(chunk []byte, m *Modifier) (Response, error)
 
@@ -51,3 +69,87 @@ type Milter interface {
 	// EndSession is called at the end of the message Handling loop
 	EndSession()
 }
+
+// UnknownMilter is an optional interface for milters handling SMTP commands unknown to the MTA,
+// without it such commands are continued
+type UnknownMilter interface {
+	// Unknown is called with the SMTP command line the MTA did not recognize
+	//   supress with NoUnknown
+	Unknown(cmd string, m *Modifier) (Response, error)
+}
+
+// DataMilter is an optional interface for milters handling the SMTP DATA command,
+// without it DATA is continued
+type DataMilter interface {
+	// Data is called for DATA, before any headers are sent
+	//   supress with NoData
+	Data(m *Modifier) (Response, error)
+}
+
+// AbortMilter is an optional interface for milters releasing message resources when
+// the MTA aborts a message, Reset is called after Abort either way
+type AbortMilter interface {
+	// Abort is called for SMFIC_ABORT before the message state is reset
+	Abort(m *Modifier)
+}
+
+// NegotiateMilter is an optional interface for milters choosing their options based on
+// what the MTA offers, without it the options returned by MilterInit are used as they are
+type NegotiateMilter interface {
+	// Negotiate is called with the actions and protocol options offered by the MTA and
+	// returns the ones the milter wants, options the MTA did not offer are masked out.
+	// It is not called for MTAs that send no offer
+	Negotiate(mtaActions OptAction, mtaProtocol OptProtocol, m *Modifier) (OptAction, OptProtocol)
+}
+
+// Capabilities is a set of the optional interfaces a Milter implements
+type Capabilities int
+
+// Define the optional interfaces reported by ValidateMilter
+const (
+	CapUnknown   Capabilities = 1 << iota // UnknownMilter
+	CapData                               // DataMilter
+	CapAbort                              // AbortMilter
+	CapNegotiate                          // NegotiateMilter
+)
+
+// capabilityNames are the interface names of the Capabilities in order
+var capabilityNames = []string{"UnknownMilter", "DataMilter", "AbortMilter", "NegotiateMilter"}
+
+// String returns the names of the interfaces in c separated by "|"
+func (c Capabilities) String() string {
+	var names []string
+	for i, name := range capabilityNames {
+		if c&(1<<uint(i)) != 0 {
+			names = append(names, name)
+		}
+	}
+	return strings.Join(names, "|")
+}
+
+// ValidateMilter returns the optional interfaces m implements, or an error if m
+// can not be used to handle a session. It is meant to be used by the tests of
+// Milter implementations
+func ValidateMilter(m Milter) (Capabilities, error) {
+	if m == nil {
+		return 0, ErrNilMilter
+	}
+	// a nil pointer would panic in the first callback not checking for it
+	if v := reflect.ValueOf(m); v.Kind() == reflect.Ptr && v.IsNil() {
+		return 0, ErrNilMilter
+	}
+	var c Capabilities
+	if _, ok := m.(UnknownMilter); ok {
+		c |= CapUnknown
+	}
+	if _, ok := m.(DataMilter); ok {
+		c |= CapData
+	}
+	if _, ok := m.(AbortMilter); ok {
+		c |= CapAbort
+	}
+	if _, ok := m.(NegotiateMilter); ok {
+		c |= CapNegotiate
+	}
+	return c, nil
+}
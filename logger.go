@@ -4,3 +4,57 @@ package milter
 type Logger interface {
 	Printf(format string, v ...interface{})
 }
+
+// NopLogger discards everything logged to it, it is used when Server.Logger is nil
+var NopLogger Logger = nopLogger{}
+
+type nopLogger struct{}
+
+func (nopLogger) Printf(format string, v ...interface{}) {}
+
+// LevelLogger is a Logger with levels, when the injected logger implements it
+// sessions log through the matching level instead of Printf. Tracing of milter
+// commands is logged with Debugf
+type LevelLogger interface {
+	Logger
+	Debugf(format string, v ...interface{})
+	Infof(format string, v ...interface{})
+	Warnf(format string, v ...interface{})
+	Errorf(format string, v ...interface{})
+}
+
+// logDebug logs to l at debug level, or with Printf if l has no levels
+func logDebug(l Logger, format string, v ...interface{}) {
+	if ll, ok := l.(LevelLogger); ok {
+		ll.Debugf(format, v...)
+		return
+	}
+	l.Printf(format, v...)
+}
+
+// logInfo logs to l at info level, or with Printf if l has no levels
+func logInfo(l Logger, format string, v ...interface{}) {
+	if ll, ok := l.(LevelLogger); ok {
+		ll.Infof(format, v...)
+		return
+	}
+	l.Printf(format, v...)
+}
+
+// logWarn logs to l at warning level, or with Printf if l has no levels
+func logWarn(l Logger, format string, v ...interface{}) {
+	if ll, ok := l.(LevelLogger); ok {
+		ll.Warnf(format, v...)
+		return
+	}
+	l.Printf(format, v...)
+}
+
+// logError logs to l at error level, or with Printf if l has no levels
+func logError(l Logger, format string, v ...interface{}) {
+	if ll, ok := l.(LevelLogger); ok {
+		ll.Errorf(format, v...)
+		return
+	}
+	l.Printf(format, v...)
+}
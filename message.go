@@ -1,11 +1,70 @@
 package milter
 
+import (
+	"encoding/binary"
+	"io"
+)
+
 // Message represents a command sent from milter client
 type Message struct {
 	Code byte
 	Data []byte
 }
 
+// ReadMessage reads a milter packet from r, packets with more than max bytes of data
+// return ErrPacketTooLarge before anything is allocated for them
+func ReadMessage(r io.Reader, max uint32) (*Message, error) {
+	// read packet length
+	var length uint32
+	if err := binary.Read(r, binary.BigEndian, &length); err != nil {
+		return nil, err
+	}
+	// the length includes the code
+	if length == 0 {
+		return nil, ErrPacketEmpty
+	}
+	if uint64(length) > uint64(max)+1 {
+		return nil, ErrPacketTooLarge
+	}
+
+	// read packet data
+	data := make([]byte, length)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return nil, err
+	}
+	return &Message{Code: data[0], Data: data[1:]}, nil
+}
+
+// WriteMessage writes msg to w as a milter packet, the packet is written at once
+func WriteMessage(w io.Writer, msg *Message) error {
+	_, err := writeMessage(w, nil, msg)
+	return err
+}
+
+// writeMessage writes msg to w building the frame in buf, the buffer used is returned
+// for reuse
+func writeMessage(w io.Writer, buf []byte, msg *Message) ([]byte, error) {
+	frame := append(buf[:0], 0, 0, 0, 0, msg.Code)
+	binary.BigEndian.PutUint32(frame, uint32(len(msg.Data)+1))
+	frame = append(frame, msg.Data...)
+	return frame, writeFull(w, frame)
+}
+
+// writeFull writes until all of data is sent
+func writeFull(w io.Writer, data []byte) error {
+	for len(data) != 0 {
+		n, err := w.Write(data)
+		if err == nil && n == 0 {
+			err = io.ErrShortWrite
+		}
+		if err != nil {
+			return err
+		}
+		data = data[n:]
+	}
+	return nil
+}
+
 // Define milter response codes
 const (
 	accept          = 'a'
@@ -13,5 +72,6 @@ const (
 	discard         = 'd'
 	reject          = 'r'
 	tempFail        = 't'
+	skip            = 's'
 	SMFIR_REPLYCODE = 'y' // SMFIR_REPLYCODE
 )
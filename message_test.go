@@ -0,0 +1,38 @@
+package milter
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+func TestReadWriteMessage(t *testing.T) {
+	var buf bytes.Buffer
+	messages := []*Message{
+		{'O', optneg(6, OptAllActions, 0)},
+		{'Q', []byte{}},
+	}
+	for _, msg := range messages {
+		if err := WriteMessage(&buf, msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if !bytes.HasPrefix(buf.Bytes(), []byte{0, 0, 0, 13, 'O'}) {
+		t.Errorf("Got frame %q", buf.Bytes())
+	}
+	for _, expected := range messages {
+		msg, err := ReadMessage(&buf, 12)
+		if err != nil || !reflect.DeepEqual(msg, expected) {
+			t.Errorf("Got %v, %v, expected %v", msg, err, expected)
+		}
+	}
+
+	// packets are checked before they are read
+	WriteMessage(&buf, &Message{'B', make([]byte, 13)})
+	if _, err := ReadMessage(&buf, 12); err != ErrPacketTooLarge {
+		t.Errorf("Expected ErrPacketTooLarge, got %v", err)
+	}
+	if _, err := ReadMessage(bytes.NewReader([]byte{0, 0, 0, 0}), 12); err != ErrPacketEmpty {
+		t.Errorf("Expected ErrPacketEmpty, got %v", err)
+	}
+}
@@ -0,0 +1,14 @@
+package milter
+
+import (
+	"time"
+)
+
+// Metrics is a interface to collect server statistics, e.g. for Prometheus
+type Metrics interface {
+	ConnectionOpened()
+	ConnectionClosed(d time.Duration)
+	// CommandProcessed is called for every command with the time it took and
+	// the error it returned if any
+	CommandProcessed(code byte, d time.Duration, err error)
+}
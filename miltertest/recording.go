@@ -0,0 +1,131 @@
+// Package miltertest provides helpers for testing milters and the milter package
+package miltertest
+
+import (
+	"net"
+	"net/textproto"
+	"sync"
+
+	"github.com/cwedgwood/milter"
+)
+
+// Call is a milter callback made by the session
+type Call struct {
+	Method string
+	Args   []interface{}
+}
+
+// RecordingMilter is a milter.Milter recording every callback with its arguments.
+// It continues at every stage and accepts at the end of the message, unless
+// Responses holds a response for the method name
+type RecordingMilter struct {
+	Responses map[string]milter.Response
+
+	mu    sync.Mutex
+	calls []Call
+}
+
+var (
+	_ milter.Milter        = (*RecordingMilter)(nil)
+	_ milter.DataMilter    = (*RecordingMilter)(nil)
+	_ milter.UnknownMilter = (*RecordingMilter)(nil)
+	_ milter.AbortMilter   = (*RecordingMilter)(nil)
+)
+
+// Calls returns the recorded callbacks in the order they were made
+func (r *RecordingMilter) Calls() []Call {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]Call(nil), r.calls...)
+}
+
+// Methods returns the names of the recorded callbacks in the order they were made
+func (r *RecordingMilter) Methods() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	methods := make([]string, len(r.calls))
+	for i, c := range r.calls {
+		methods[i] = c.Method
+	}
+	return methods
+}
+
+// record adds a call and returns the response for it
+func (r *RecordingMilter) record(method string, fallback milter.Response, args ...interface{}) (milter.Response, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.calls = append(r.calls, Call{method, args})
+	if resp, ok := r.Responses[method]; ok {
+		return resp, nil
+	}
+	return fallback, nil
+}
+
+// NewSession records the call
+func (r *RecordingMilter) NewSession(milter.Logger) { r.record("NewSession", nil) }
+
+// NewMessage records the call
+func (r *RecordingMilter) NewMessage() { r.record("NewMessage", nil) }
+
+// Reset records the call
+func (r *RecordingMilter) Reset() { r.record("Reset", nil) }
+
+// EndSession records the call
+func (r *RecordingMilter) EndSession() { r.record("EndSession", nil) }
+
+// Connect records the call
+func (r *RecordingMilter) Connect(host string, family string, port uint16, addr net.IP, m *milter.Modifier) (milter.Response, error) {
+	return r.record("Connect", milter.RespContinue, host, family, port, addr)
+}
+
+// Helo records the call
+func (r *RecordingMilter) Helo(name string, m *milter.Modifier) (milter.Response, error) {
+	return r.record("Helo", milter.RespContinue, name)
+}
+
+// MailFrom records the call
+func (r *RecordingMilter) MailFrom(from string, esmtpArgs []string, m *milter.Modifier) (milter.Response, error) {
+	return r.record("MailFrom", milter.RespContinue, from, esmtpArgs)
+}
+
+// RcptTo records the call
+func (r *RecordingMilter) RcptTo(rcptTo string, esmtpArgs []string, m *milter.Modifier) (milter.Response, error) {
+	return r.record("RcptTo", milter.RespContinue, rcptTo, esmtpArgs)
+}
+
+// Data records the call
+func (r *RecordingMilter) Data(m *milter.Modifier) (milter.Response, error) {
+	return r.record("Data", milter.RespContinue)
+}
+
+// Unknown records the call
+func (r *RecordingMilter) Unknown(cmd string, m *milter.Modifier) (milter.Response, error) {
+	return r.record("Unknown", milter.RespContinue, cmd)
+}
+
+// Abort records the call
+func (r *RecordingMilter) Abort(m *milter.Modifier) { r.record("Abort", nil) }
+
+// Header records the call
+func (r *RecordingMilter) Header(name string, value string, m *milter.Modifier) (milter.Response, error) {
+	return r.record("Header", milter.RespContinue, name, value)
+}
+
+// Headers records the call with a copy of the headers
+func (r *RecordingMilter) Headers(h textproto.MIMEHeader, m *milter.Modifier) (milter.Response, error) {
+	headers := make(textproto.MIMEHeader, len(h))
+	for k, v := range h {
+		headers[k] = append([]string(nil), v...)
+	}
+	return r.record("Headers", milter.RespContinue, headers)
+}
+
+// BodyChunk records the call with a copy of the chunk
+func (r *RecordingMilter) BodyChunk(chunk []byte, m *milter.Modifier) (milter.Response, error) {
+	return r.record("BodyChunk", milter.RespContinue, append([]byte(nil), chunk...))
+}
+
+// Body records the call
+func (r *RecordingMilter) Body(m *milter.Modifier) (milter.Response, error) {
+	return r.record("Body", milter.RespAccept)
+}
@@ -0,0 +1,108 @@
+package miltertest
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"net/textproto"
+	"reflect"
+	"testing"
+
+	"github.com/cwedgwood/milter"
+)
+
+// send writes a command packet and returns the reply code, or 0 for commands without reply
+func send(t *testing.T, conn net.Conn, code byte, data string) byte {
+	t.Helper()
+	packet := make([]byte, 5, 5+len(data))
+	binary.BigEndian.PutUint32(packet, uint32(len(data)+1))
+	packet[4] = code
+	if _, err := conn.Write(append(packet, data...)); err != nil {
+		t.Fatal(err)
+	}
+	if code == 'D' || code == 'Q' {
+		return 0
+	}
+	var length uint32
+	if err := binary.Read(conn, binary.BigEndian, &length); err != nil {
+		t.Fatal(err)
+	}
+	reply := make([]byte, length)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		t.Fatal(err)
+	}
+	return reply[0]
+}
+
+func TestRecordingMilter(t *testing.T) {
+	recorder := &RecordingMilter{}
+	socket, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &milter.Server{
+		Listener: socket,
+		MilterFactory: func() (milter.Milter, milter.OptAction, milter.OptProtocol) {
+			return recorder, 0, 0
+		},
+	}
+	go server.RunServer()
+
+	conn, err := net.Dial("tcp", socket.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	script := []struct {
+		code  byte
+		data  string
+		reply byte
+	}{
+		{'O', "", 'O'},
+		{'C', "client.example.org\x004\x00\x19192.0.2.1\x00", 'c'},
+		{'H', "client.example.org\x00", 'c'},
+		{'M', "<from@example.org>\x00SIZE=100\x00", 'c'},
+		{'R', "<to@example.com>\x00", 'c'},
+		{'T', "", 'c'},
+		{'L', "Subject\x00Hello\x00", 'c'},
+		{'L', "To\x00to@example.com\x00", 'c'},
+		{'N', "", 'c'},
+		{'B', "first chunk", 'c'},
+		{'B', "second chunk", 'c'},
+		{'E', "", 'a'},
+		{'Q', "", 0},
+	}
+	for _, step := range script {
+		if reply := send(t, conn, step.code, step.data); reply != step.reply {
+			t.Errorf("Command %c: expected reply %c, got %c", step.code, step.reply, reply)
+		}
+	}
+	conn.Close()
+	server.Close()
+
+	expected := []string{"NewSession", "Connect", "Helo", "NewMessage", "MailFrom", "RcptTo", "Data",
+		"Header", "Header", "Headers", "BodyChunk", "BodyChunk", "Body", "EndSession"}
+	if methods := recorder.Methods(); !reflect.DeepEqual(methods, expected) {
+		t.Errorf("Got callbacks %v, expected %v", methods, expected)
+	}
+	calls := recorder.Calls()
+	if connect := calls[1].Args; !reflect.DeepEqual(connect, []interface{}{"client.example.org", "tcp4", uint16(25), net.ParseIP("192.0.2.1")}) {
+		t.Errorf("Got Connect arguments %v", connect)
+	}
+	if args := calls[4].Args; !reflect.DeepEqual(args, []interface{}{"from@example.org", []string{"SIZE=100"}}) {
+		t.Errorf("Got MailFrom arguments %v", args)
+	}
+	headers := textproto.MIMEHeader{"Subject": {"Hello"}, "To": {"to@example.com"}}
+	if args := calls[9].Args; !reflect.DeepEqual(args, []interface{}{headers}) {
+		t.Errorf("Got Headers arguments %v", args)
+	}
+	if args := calls[11].Args; !reflect.DeepEqual(args, []interface{}{[]byte("second chunk")}) {
+		t.Errorf("Got BodyChunk arguments %v", args)
+	}
+}
+
+func TestRecordingMilterCapabilities(t *testing.T) {
+	c, err := milter.ValidateMilter(&RecordingMilter{})
+	if expected := milter.CapUnknown | milter.CapData | milter.CapAbort; err != nil || c != expected {
+		t.Errorf("Expected %v, got %v %v", expected, c, err)
+	}
+}
@@ -6,82 +6,309 @@ import (
 	"bytes"
 	"encoding/binary"
 	"fmt"
+	"io"
+	"net"
 	"net/textproto"
+	"strings"
+	"sync/atomic"
+	"time"
 )
 
 // Modifier provides access to Macros, Headers and Body data to callback handlers. It also defines a
-// number of functions that can be used by callback handlers to modify processing of the email message
+// number of functions that can be used by callback handlers to modify processing of the email message.
+// Headers reflects the header changes the milter made through the Modifier.
+// A Modifier is only valid until the callback it was passed to returns and must not be
+// used by other goroutines, modifications made later return ErrModifierExpired
 type Modifier struct {
 	Macros      map[string]string
 	Headers     textproto.MIMEHeader
 	writePacket func(*Message) error
+	session     *milterSession
+	// command the Modifier was created for
+	command uint64
+	// modifications are queued by Batch, along with the updates of the tracked headers
+	// to make once they are sent
+	batch   bool
+	tracked *[]func()
 }
 
 // AddRecipient appends a new envelope recipient for current message
 func (m *Modifier) AddRecipient(r string) error {
+	if err := m.negotiated(OptAddRcpt); err != nil {
+		return err
+	}
 	data := []byte(fmt.Sprintf("<%s>", r) + null)
 	return m.writePacket(NewResponse('+', data).Response())
 }
 
+// AddRecipients appends new envelope recipients for current message, no recipient is
+// added unless OptAddRcpt was negotiated and all addresses are valid
+func (m *Modifier) AddRecipients(addrs ...string) error {
+	if err := m.negotiated(OptAddRcpt); err != nil {
+		return err
+	}
+	for _, r := range addrs {
+		if r == "" || strings.ContainsAny(r, "<>\r\n"+null) {
+			return ErrInvalidAddress
+		}
+	}
+	for _, r := range addrs {
+		if err := m.AddRecipient(r); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// AddRecipientWithArgs appends a new envelope recipient with ESMTP arguments (e.g.
+// "NOTIFY=NEVER") for current message, this requires OptAddRcptPartial
+func (m *Modifier) AddRecipientWithArgs(r, args string) error {
+	if err := m.negotiated(OptAddRcptPartial); err != nil {
+		return err
+	}
+	data := []byte(fmt.Sprintf("<%s>", r) + null + args + null)
+	return m.writePacket(NewResponse('2', data).Response())
+}
+
 // DeleteRecipient removes an envelope recipient address from message
 func (m *Modifier) DeleteRecipient(r string) error {
+	if err := m.negotiated(OptRemoveRcpt); err != nil {
+		return err
+	}
 	data := []byte(fmt.Sprintf("<%s>", r) + null)
 	return m.writePacket(NewResponse('-', data).Response())
 }
 
-// ReplaceBody substitutes message body with provided body
+// ReplaceBody substitutes message body with provided body, repeated calls append to
+// the new body. Nothing is sent to the MTA until Body returns, and only if the new
+// body is not empty and Body accepts the message. Large bodies are split to fit the
+// negotiated maximum size
 func (m *Modifier) ReplaceBody(body []byte) error {
-	return m.writePacket(NewResponse('b', body).Response())
+	if err := m.negotiated(OptChangeBody); err != nil {
+		return err
+	}
+	m.session.newBody = append(m.session.newBody, body...)
+	return nil
+}
+
+// ReplaceBodyString is ReplaceBody for a string body
+func (m *Modifier) ReplaceBodyString(body string) error {
+	return m.ReplaceBody([]byte(body))
+}
+
+// AppendBody replaces the message body with the body followed by s, e.g. to add a
+// footer. It needs Server.BufferBody, the body is the one from ReplaceBody if that was
+// called before, the original body otherwise
+func (m *Modifier) AppendBody(s []byte) error {
+	body, err := m.currentBody()
+	if err != nil {
+		return err
+	}
+	m.session.newBody = append(append([]byte(nil), body...), s...)
+	return nil
 }
 
-// AddHeader appends a new email message header the message
+// PrependBody replaces the message body with s followed by the body, like AppendBody
+func (m *Modifier) PrependBody(s []byte) error {
+	body, err := m.currentBody()
+	if err != nil {
+		return err
+	}
+	m.session.newBody = append(append([]byte(nil), s...), body...)
+	return nil
+}
+
+// currentBody returns the replacement body if there is one, else the buffered body
+func (m *Modifier) currentBody() ([]byte, error) {
+	if err := m.negotiated(OptChangeBody); err != nil {
+		return nil, err
+	}
+	if m.session.newBody != nil {
+		return m.session.newBody, nil
+	}
+	if !m.session.bufferBody || m.session.bodyOverflow {
+		return nil, ErrBodyNotBuffered
+	}
+	return m.session.body, nil
+}
+
+// ReplaceBodyReader substitutes message body with the contents of r, the body is sent
+// to the MTA right away in packets of the negotiated maximum size. It has to be called
+// from Body, a body passed to ReplaceBody before is sent first
+func (m *Modifier) ReplaceBodyReader(r io.Reader) error {
+	if err := m.negotiated(OptChangeBody); err != nil {
+		return err
+	}
+	if len(m.session.newBody) != 0 {
+		if err := m.session.writeBody(m.writePacket, m.session.newBody); err != nil {
+			return err
+		}
+		m.session.newBody = nil
+	}
+	chunk := make([]byte, m.session.maxReplySize())
+	for {
+		n, err := io.ReadFull(r, chunk)
+		if n > 0 {
+			if err := m.session.writeBody(m.writePacket, chunk[:n]); err != nil {
+				return err
+			}
+		}
+		switch err {
+		case nil:
+		case io.EOF, io.ErrUnexpectedEOF:
+			return nil
+		default:
+			return err
+		}
+	}
+}
+
+// AddHeader appends a new email message header the message, headers larger than the
+// negotiated maximum size return ErrPacketTooLarge. Header names have to be RFC 5322
+// field names and values can only contain folding line breaks, or ErrInvalidHeader is
+// returned, this applies to ChangeHeader and InsertHeader as well
 func (m *Modifier) AddHeader(name, value string) error {
-	data := []byte(name + null + value + null)
-	return m.writePacket(NewResponse('h', data).Response())
+	if err := m.negotiated(OptAddHeader); err != nil {
+		return err
+	}
+	if !validHeader(name, value) {
+		return ErrInvalidHeader
+	}
+	data := []byte(name + null + m.headerValue(value) + null)
+	if len(data) > m.session.maxReplySize() {
+		return ErrPacketTooLarge
+	}
+	if err := m.writePacket(NewResponse('h', data).Response()); err != nil {
+		return err
+	}
+	m.track(func() { m.trackedHeaders().Add(name, value) })
+	return nil
 }
 
-// Quarantine a message by giving a reason to hold it
+// Quarantine a message by giving a reason to hold it, this requires OptQuarantine
 func (m *Modifier) Quarantine(reason string) error {
+	if err := m.negotiated(OptQuarantine); err != nil {
+		return err
+	}
 	return m.writePacket(NewResponse('q', []byte(reason+null)).Response())
 }
 
-// ChangeHeader replaces the header at the specified position with a new one
+// ChangeHeader replaces the header at the specified position with a new one, the
+// index is 1-based and counts only headers with the same name, negative indices
+// return ErrInvalidHeaderIndex
 func (m *Modifier) ChangeHeader(index int, name, value string) error {
+	if err := m.negotiated(OptChangeHeader); err != nil {
+		return err
+	}
+	if index < 0 {
+		return ErrInvalidHeaderIndex
+	}
+	if !validHeader(name, value) {
+		return ErrInvalidHeader
+	}
 	buffer := new(bytes.Buffer)
 	// encode header index in the beginning
 	if err := binary.Write(buffer, binary.BigEndian, uint32(index)); err != nil {
 		return err
 	}
 	// add header name and value to buffer
-	data := []byte(name + null + value + null)
+	data := []byte(name + null + m.headerValue(value) + null)
 	if _, err := buffer.Write(data); err != nil {
 		return err
 	}
+	if buffer.Len() > m.session.maxReplySize() {
+		return ErrPacketTooLarge
+	}
 	// prepare and send response packet
-	return m.writePacket(NewResponse('m', buffer.Bytes()).Response())
+	if err := m.writePacket(NewResponse('m', buffer.Bytes()).Response()); err != nil {
+		return err
+	}
+	// keep tracked headers in line with the change, the index is 1-based per header
+	// name and the MTA adds the header if there is no such occurrence
+	m.track(func() {
+		headers := m.trackedHeaders()
+		key := textproto.CanonicalMIMEHeaderKey(name)
+		values := headers[key]
+		switch {
+		case index < 1 || index > len(values):
+			if value != "" {
+				headers.Add(key, value)
+			}
+		case value == "":
+			headers[key] = append(values[:index-1], values[index:]...)
+			if len(headers[key]) == 0 {
+				delete(headers, key)
+			}
+		default:
+			values[index-1] = value
+		}
+	})
+	return nil
+}
+
+// DeleteHeaderByName removes all occurrences of the named header, the last one first
+// so that deleting does not shift the index of the remaining ones
+func (m *Modifier) DeleteHeaderByName(name string) error {
+	if err := m.negotiated(OptChangeHeader); err != nil {
+		return err
+	}
+	for index := m.HeaderCount(name); index > 0; index-- {
+		if err := m.ChangeHeader(index, name, ""); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
-// InsertHeader inserts the header at the pecified position
+// InsertHeader inserts the header at the specified position in the list of all
+// headers, index 0 inserts it before the first header and index N after the Nth
+// one, an index past the last header appends it.  Negative indices return
+// ErrInvalidHeaderIndex
 func (m *Modifier) InsertHeader(index int, name, value string) error {
+	if err := m.negotiated(OptAddHeader); err != nil {
+		return err
+	}
+	if index < 0 {
+		return ErrInvalidHeaderIndex
+	}
+	if !validHeader(name, value) {
+		return ErrInvalidHeader
+	}
 	buffer := new(bytes.Buffer)
 	// encode header index in the beginning
 	if err := binary.Write(buffer, binary.BigEndian, uint32(index)); err != nil {
 		return err
 	}
 	// add header name and value to buffer
-	data := []byte(name + null + value + null)
+	data := []byte(name + null + m.headerValue(value) + null)
 	if _, err := buffer.Write(data); err != nil {
 		return err
 	}
+	if buffer.Len() > m.session.maxReplySize() {
+		return ErrPacketTooLarge
+	}
 	// prepare and send response packet
-	return m.writePacket(NewResponse('i', buffer.Bytes()).Response())
+	if err := m.writePacket(NewResponse('i', buffer.Bytes()).Response()); err != nil {
+		return err
+	}
+	// tracked headers do not keep the order of different header names
+	m.track(func() { m.trackedHeaders().Add(name, value) })
+	return nil
 }
 
-// ChangeFrom replaces the FROM envelope header with a new one
+// ChangeFrom replaces the FROM envelope header with a new one, the ESMTP arguments
+// of the original MAIL FROM (see SenderArgs) are sent along so that e.g. SIZE and
+// RET are kept
 func (m *Modifier) ChangeFrom(value string) error {
+	if err := m.negotiated(OptChangeFrom); err != nil {
+		return err
+	}
 	buffer := new(bytes.Buffer)
 	// add header name and value to buffer
 	data := []byte(value + null)
+	if len(m.session.senderArgs) != 0 {
+		data = append(data, strings.Join(m.session.senderArgs, " ")+null...)
+	}
 	if _, err := buffer.Write(data); err != nil {
 		return err
 	}
@@ -89,11 +316,387 @@ func (m *Modifier) ChangeFrom(value string) error {
 	return m.writePacket(NewResponse('e', buffer.Bytes()).Response())
 }
 
+// ChangeFromWithArgs replaces the FROM envelope header with a new one passing ESMTP
+// arguments (e.g. "BODY=8BITMIME") along instead of the original ones, empty args
+// drop them. This requires OptChangeFrom
+func (m *Modifier) ChangeFromWithArgs(value, args string) error {
+	if err := m.negotiated(OptChangeFrom); err != nil {
+		return err
+	}
+	data := []byte(value + null + args + null)
+	return m.writePacket(NewResponse('e', data).Response())
+}
+
+// SetSymList asks the MTA to send only the named macros at stage, one of the SymList
+// constants. It can only be called from Negotiate and requires the MTA to offer
+// OptSetSymList, the lists are sent along with the negotiated options
+func (m *Modifier) SetSymList(stage int, macros []string) error {
+	if !m.session.negotiating {
+		return ErrNotNegotiating
+	}
+	if m.session.mtaActions&OptSetSymList == 0 {
+		return ErrActionNotNegotiated
+	}
+	if stage < SymListConnect || stage > SymListEOH {
+		return ErrInvalidSymListStage
+	}
+	if m.session.symLists == nil {
+		m.session.symLists = make(map[int]string)
+	}
+	m.session.symLists[stage] = strings.Join(macros, " ")
+	return nil
+}
+
+// BodyReader returns the body of the current message received so far, typically
+// used from Body to parse the whole message. It requires Server.BufferBody, else
+// the body is empty
+func (m *Modifier) BodyReader() io.Reader {
+	return bytes.NewReader(m.session.body)
+}
+
+// BodyLines makes the session call fn for every complete line of the current message
+// body, regardless of how the MTA splits the body into chunks. Lines include their line
+// ending and must not be retained after fn returns. Lines longer than 64 KiB are passed
+// on in 64 KiB pieces. Call it before the body is sent (e.g. from Headers), an
+// unterminated last line is delivered before Body is called
+func (m *Modifier) BodyLines(fn func(line []byte)) {
+	m.session.bodyLines = &lineWriter{fn: fn}
+}
+
+// Macro returns the value of the named macro. Sendmail sends single character macro
+// names as is ("i") and longer names in braces ("{auth_authen}"), the name can be
+// given with or without the braces
+func (m *Modifier) Macro(name string) (string, bool) {
+	name = strings.TrimSuffix(strings.TrimPrefix(name, "{"), "}")
+	if value, ok := m.session.macros[name]; ok {
+		return value, true
+	}
+	value, ok := m.session.macros["{"+name+"}"]
+	return value, ok
+}
+
+// StageMacro returns the value of the named macro as sent for the stage with command
+// code stage, e.g. 'C' for Connect or 'R' for the current RcptTo. Unlike Macro it is
+// not overwritten by macros of the same name sent at later stages, names are
+// handled as in Macro. The macros of 'R' are only kept during RcptTo, see
+// RecipientMacros for later stages
+func (m *Modifier) StageMacro(stage byte, name string) (string, bool) {
+	macros := m.session.stageMacros[stage]
+	name = strings.TrimSuffix(strings.TrimPrefix(name, "{"), "}")
+	if value, ok := macros[name]; ok {
+		return value, true
+	}
+	value, ok := macros["{"+name+"}"]
+	return value, ok
+}
+
+// BodySize returns the number of body bytes received for the current message so far,
+// including skipped chunks. It starts from zero with each MAIL FROM and abort, e.g.
+// BodyChunk can reject messages once it passes a limit
+func (m *Modifier) BodySize() int64 {
+	return m.session.bodySize
+}
+
+// SessionID returns the ID generated by Server.NewSessionID for the session
+func (m *Modifier) SessionID() string {
+	return m.session.sessionID
+}
+
+// MessageID returns the ID generated by Server.NewMessageID for the current message
+func (m *Modifier) MessageID() string {
+	return m.session.messageID
+}
+
+// Stage returns the protocol stage of the callback the Modifier was passed to
+func (m *Modifier) Stage() Stage {
+	return m.session.stage
+}
+
+// Helo returns the name given with the last HELO or EHLO of the session
+func (m *Modifier) Helo() string {
+	return m.session.helo
+}
+
+// ConnectHost returns the host name of the client as passed to Connect
+func (m *Modifier) ConnectHost() string {
+	return m.session.host
+}
+
+// ConnectAddr returns the address of the client as passed to Connect
+func (m *Modifier) ConnectAddr() net.IP {
+	return m.session.addr
+}
+
+// SocketPath returns the path of the unix socket the client connected to, for such
+// connections ConnectAddr is nil
+func (m *Modifier) SocketPath() string {
+	return m.session.socketPath
+}
+
+// ClientPTR returns the PTR record of the client address from the {client_ptr}
+// macro. The MTA sends the macros of a stage before its command, so it is available
+// in Connect if the MTA sends it (postfix needs it in milter_connect_macros or a
+// SetSymList for SymListConnect)
+func (m *Modifier) ClientPTR() string {
+	value, _ := m.Macro("client_ptr")
+	return value
+}
+
+// ClientResolve returns the result of the client's reverse DNS lookup from the
+// {client_resolve} macro: OK, FAIL, FORGED or TEMP. Like ClientPTR it is available
+// in Connect
+func (m *Modifier) ClientResolve() string {
+	value, _ := m.Macro("client_resolve")
+	return value
+}
+
+// SenderArgs returns the ESMTP arguments of the MAIL FROM of the current message
+func (m *Modifier) SenderArgs() []string {
+	return append([]string(nil), m.session.senderArgs...)
+}
+
+// RawHeaderValue returns the value of the header passed to Header as sent by the MTA,
+// it differs from the value if Server.UnfoldHeaders is set and the header was folded
+func (m *Modifier) RawHeaderValue() string {
+	if len(m.session.rawHeaders) == 0 {
+		return ""
+	}
+	return m.session.rawHeaders[len(m.session.rawHeaders)-1].Value
+}
+
+// Sender returns the envelope sender of the current message as passed to MailFrom
+func (m *Modifier) Sender() string {
+	return m.session.sender
+}
+
+// RawSender returns the envelope sender of the current message as sent by the MTA
+func (m *Modifier) RawSender() string {
+	return m.session.rawSender
+}
+
+// Recipients returns the envelope recipients of the current message that were
+// not rejected by RcptTo, in the order they were received
+func (m *Modifier) Recipients() []string {
+	return append([]string(nil), m.session.recipients...)
+}
+
+// RecipientMacros returns the macros the MTA sent with the RCPT of rcpt, one of
+// Recipients, e.g. {rcpt_addr} and {rcpt_mailer} for routing decisions in Body.
+// Within RcptTo the macros of the current recipient are available from
+// StageMacro('R', name)
+func (m *Modifier) RecipientMacros(rcpt string) map[string]string {
+	macros, ok := m.session.recipientMacros[rcpt]
+	if !ok {
+		return nil
+	}
+	copied := make(map[string]string, len(macros))
+	for name, value := range macros {
+		copied[name] = value
+	}
+	return copied
+}
+
+// RecipientRejected reports whether the MTA already rejected the recipient passed
+// to RcptTo, it only sends those if the milter requested OptRcptRej. Rejected
+// recipients are not included in Recipients
+func (m *Modifier) RecipientRejected() bool {
+	return m.session.rcptRejected()
+}
+
+// ProtocolVersion returns the milter protocol version agreed on with the MTA, the
+// lower of the version it offered and 6
+func (m *Modifier) ProtocolVersion() uint32 {
+	return m.session.version
+}
+
+// CanSkip reports whether OptSkip was requested by the milter and offered by the MTA,
+// only then may BodyChunk ask the MTA to skip the remaining body chunks
+func (m *Modifier) CanSkip() bool {
+	return m.session.negotiatedProtocol()&OptSkip != 0
+}
+
+// HeaderCount returns the number of occurrences of the named header, this includes
+// the changes already made by the milter
+func (m *Modifier) HeaderCount(name string) int {
+	return len(m.session.headers[textproto.CanonicalMIMEHeaderKey(name)])
+}
+
+// OriginalHeaderName returns the name of the first header matching name as sent by the
+// MTA, before it was canonicalized for Headers. It returns "" if there is no such header
+func (m *Modifier) OriginalHeaderName(name string) string {
+	key := textproto.CanonicalMIMEHeaderKey(name)
+	for _, h := range m.session.rawHeaders {
+		if textproto.CanonicalMIMEHeaderKey(h.Name) == key {
+			return h.Name
+		}
+	}
+	return ""
+}
+
+// RawHeader is a header as sent by the MTA
+type RawHeader struct {
+	Name, Value string
+}
+
+// RawHeaders returns the headers of the current message received so far in their
+// order and exactly as sent by the MTA, e.g. for DKIM verification. Changes made by
+// the milter are not included
+func (m *Modifier) RawHeaders() []RawHeader {
+	return append([]RawHeader(nil), m.session.rawHeaders...)
+}
+
+// trackedHeaders returns the session headers which Modifier.Headers refers to
+func (m *Modifier) trackedHeaders() textproto.MIMEHeader {
+	if m.session.headers == nil {
+		m.session.headers = make(textproto.MIMEHeader)
+	}
+	m.Headers = m.session.headers
+	return m.Headers
+}
+
+// track updates the tracked headers after a modification was sent, in a batch only
+// once the whole batch is
+func (m *Modifier) track(update func()) {
+	if m.batch {
+		*m.tracked = append(*m.tracked, update)
+		return
+	}
+	update()
+}
+
+// Progress tells the MTA to keep waiting for the response of the current callback,
+// it can be sent any number of times by callbacks that take a long time to finish
+func (m *Modifier) Progress() error {
+	return m.writePacket(NewResponse('p', nil).Response())
+}
+
+// Delay holds back the response of the current callback for d, e.g. to slow down
+// abusive senders. The delay ends early if the MTA closes the connection
+func (m *Modifier) Delay(d time.Duration) {
+	m.session.delay = d
+}
+
+// headerValue prepares a header value for the MTA, with OptHdrLeadSpace negotiated
+// the MTA does not put a space after the colon so the value has to start with one
+func (m *Modifier) headerValue(value string) string {
+	if m.session.negotiatedProtocol()&OptHdrLeadSpace == 0 || value == "" {
+		return value
+	}
+	if value[0] != ' ' && value[0] != '\t' {
+		return " " + value
+	}
+	return value
+}
+
+// validHeader reports whether name is a RFC 5322 field name and value has no NULs or
+// line breaks other than folding, anything else would let the header spill over into
+// further headers or the body
+func validHeader(name, value string) bool {
+	if name == "" {
+		return false
+	}
+	for i := 0; i < len(name); i++ {
+		if c := name[i]; c < 33 || c > 126 || c == ':' {
+			return false
+		}
+	}
+	for i := 0; i < len(value); i++ {
+		switch value[i] {
+		case 0:
+			return false
+		case '\r':
+			if i+1 == len(value) || value[i+1] != '\n' {
+				return false
+			}
+		case '\n':
+			if i+1 == len(value) || (value[i+1] != ' ' && value[i+1] != '\t') {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// negotiated returns ErrActionNotNegotiated unless the milter asked for action and the
+// MTA offered it, the MTA closes connections sending modifications that were not negotiated
+func (m *Modifier) negotiated(action OptAction) error {
+	if m.expired() {
+		return ErrModifierExpired
+	}
+	if m.session.actions&m.session.mtaActions&action == 0 {
+		return ErrActionNotNegotiated
+	}
+	return nil
+}
+
+// ModBatch makes the modifications of a Modifier.Batch, they are checked and return
+// errors as usual but sent together
+type ModBatch struct {
+	*Modifier
+}
+
+// Batch calls fn and sends the modifications it makes through b in a single write
+// once it returns, instead of one write each. The error of that write is returned,
+// errors of single modifications are returned by them. Progress reports are sent
+// right away. If fn panics no modification is sent. Headers reflects the header
+// changes of the batch only after it was sent
+func (m *Modifier) Batch(fn func(b *ModBatch)) error {
+	if m.expired() {
+		return ErrModifierExpired
+	}
+	// nested batches are part of the outer one
+	if m.batch {
+		fn(&ModBatch{m})
+		return nil
+	}
+	var frames bytes.Buffer
+	var frame []byte
+	var tracked []func()
+	batch := *m
+	batch.batch = true
+	batch.tracked = &tracked
+	batch.writePacket = func(msg *Message) error {
+		if msg.Code == 'p' {
+			return m.writePacket(msg)
+		}
+		if m.expired() {
+			return ErrModifierExpired
+		}
+		frame, _ = writeMessage(&frames, frame, msg)
+		return nil
+	}
+	fn(&ModBatch{&batch})
+	if frames.Len() == 0 {
+		return nil
+	}
+	if err := m.session.writeFrames(frames.Bytes()); err != nil {
+		return err
+	}
+	for _, update := range tracked {
+		update()
+	}
+	m.Headers = batch.Headers
+	return nil
+}
+
 // newModifier creates a new Modifier instance from milterSession
 func newModifier(s *milterSession) *Modifier {
-	return &Modifier{
-		Macros:      s.macros,
-		Headers:     s.headers,
-		writePacket: s.WritePacket,
+	m := &Modifier{
+		Macros:  s.macros,
+		Headers: s.headers,
+		session: s,
+		command: atomic.LoadUint64(&s.command),
+	}
+	m.writePacket = func(msg *Message) error {
+		if m.expired() {
+			return ErrModifierExpired
+		}
+		return s.WritePacket(msg)
 	}
+	return m
+}
+
+// expired reports whether the callback the Modifier was passed to has returned
+func (m *Modifier) expired() bool {
+	return atomic.LoadUint64(&m.session.command) != m.command
 }
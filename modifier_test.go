@@ -0,0 +1,1382 @@
+package milter
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/textproto"
+	"reflect"
+	"regexp"
+	"testing"
+	"time"
+)
+
+func TestModifierBodyLines(t *testing.T) {
+	var lines []string
+	milter := &hookMilter{
+		headers: func(h textproto.MIMEHeader, m *Modifier) (Response, error) {
+			m.BodyLines(func(line []byte) {
+				lines = append(lines, string(line))
+			})
+			return RespContinue, nil
+		},
+	}
+	session, sock, _ := newTestSession(milter, 0, 0)
+	sock.send('N', nil)
+	for _, chunk := range []string{"first li", "ne\r\nsecond line\r\nthi", "rd", " line\r\n", "last"} {
+		sock.send('B', []byte(chunk))
+	}
+	sock.send('E', nil)
+	session.HandleMilterCommands()
+
+	expected := []string{"first line\r\n", "second line\r\n", "third line\r\n", "last"}
+	if !reflect.DeepEqual(lines, expected) {
+		t.Errorf("Got lines %q, expected %q", lines, expected)
+	}
+}
+
+func TestModifierBodyLinesLongLine(t *testing.T) {
+	var lines []int
+	milter := &hookMilter{
+		headers: func(h textproto.MIMEHeader, m *Modifier) (Response, error) {
+			m.BodyLines(func(line []byte) {
+				lines = append(lines, len(line))
+			})
+			return RespContinue, nil
+		},
+	}
+	session, sock, _ := newTestSession(milter, 0, 0)
+	sock.send('N', nil)
+	// a body without line breaks must not be buffered whole
+	chunk := bytes.Repeat([]byte("x"), 50*1024)
+	for i := 0; i < 3; i++ {
+		sock.send('B', chunk)
+	}
+	sock.send('B', []byte("\r\n"))
+	sock.send('E', nil)
+	session.HandleMilterCommands()
+
+	expected := []int{maxBodyLine, maxBodyLine, 150*1024 - 2*maxBodyLine + 2}
+	if !reflect.DeepEqual(lines, expected) {
+		t.Errorf("Got line lengths %v, expected %v", lines, expected)
+	}
+}
+
+func TestModifierCanSkip(t *testing.T) {
+	tests := []struct {
+		name     string
+		protocol OptProtocol
+		offer    []byte
+		expected bool
+	}{
+		{"negotiated", OptSkip, optneg(6, OptAllActions, OptSkip|OptNoHelo), true},
+		{"not requested", OptNoHelo, optneg(6, OptAllActions, OptSkip|OptNoHelo), false},
+		{"not offered", OptSkip, optneg(6, OptAllActions, OptNoHelo), false},
+		{"legacy MTA", OptSkip, nil, false},
+	}
+	for _, test := range tests {
+		var canSkip bool
+		milter := &hookMilter{
+			bodyChunk: func(chunk []byte, m *Modifier) (Response, error) {
+				canSkip = m.CanSkip()
+				return RespContinue, nil
+			},
+		}
+		session, sock, _ := newTestSession(milter, 0, test.protocol)
+		sock.send('O', test.offer)
+		sock.send('B', []byte("body"))
+		session.HandleMilterCommands()
+		if canSkip != test.expected {
+			t.Errorf("%s: CanSkip returned %v, expected %v", test.name, canSkip, test.expected)
+		}
+	}
+}
+
+func TestModifierAddRecipients(t *testing.T) {
+	addrs := []string{"a@example.com", "b@example.com", "c@example.com", "d@example.com", "e@example.com"}
+	tests := []struct {
+		name    string
+		actions OptAction
+		addrs   []string
+		err     error
+	}{
+		{"valid", OptAddRcpt, addrs, nil},
+		{"invalid address", OptAddRcpt, append(addrs[:4:4], "bad\r\naddress"), ErrInvalidAddress},
+		{"empty address", OptAddRcpt, append(addrs[:4:4], ""), ErrInvalidAddress},
+		{"not negotiated", OptAddHeader, addrs, ErrActionNotNegotiated},
+	}
+	for _, test := range tests {
+		var err error
+		milter := &hookMilter{
+			body: func(m *Modifier) (Response, error) {
+				err = m.AddRecipients(test.addrs...)
+				return RespAccept, nil
+			},
+		}
+		session, sock, _ := newTestSession(milter, test.actions, 0)
+		sock.send('E', nil)
+		session.HandleMilterCommands()
+
+		if err != test.err {
+			t.Errorf("%s: got error %v, expected %v", test.name, err, test.err)
+		}
+		var added []string
+		for _, msg := range sock.replies(t) {
+			if msg.Code == '+' {
+				added = append(added, readCString(msg.Data))
+			}
+		}
+		if test.err != nil {
+			if len(added) != 0 {
+				t.Errorf("%s: expected no recipients to be added, got %q", test.name, added)
+			}
+			continue
+		}
+		if len(added) != len(test.addrs) {
+			t.Errorf("%s: got recipients %q, expected %q", test.name, added, test.addrs)
+			continue
+		}
+		for i, addr := range test.addrs {
+			if added[i] != "<"+addr+">" {
+				t.Errorf("%s: got recipients %q, expected %q", test.name, added, test.addrs)
+				break
+			}
+		}
+	}
+}
+
+func TestModifierEnvelope(t *testing.T) {
+	var sender, rawSender string
+	var recipients []string
+	milter := &hookMilter{
+		rcptTo: func(rcpt string, args []string, m *Modifier) (Response, error) {
+			if rcpt == "spam@example.com" {
+				return RespReject, nil
+			}
+			return RespContinue, nil
+		},
+		body: func(m *Modifier) (Response, error) {
+			sender, rawSender, recipients = m.Sender(), m.RawSender(), m.Recipients()
+			return RespAccept, nil
+		},
+	}
+	session, sock, _ := newTestSession(milter, 0, 0)
+	sock.send('M', cstrings("<Someone@Example.com>", "SIZE=100"))
+	sock.send('R', cstrings("<first@example.com>"))
+	sock.send('R', cstrings("<spam@example.com>"))
+	sock.send('R', cstrings("<Second@example.com>"))
+	sock.send('E', nil)
+	session.HandleMilterCommands()
+
+	if sender != "someone@example.com" || rawSender != "<Someone@Example.com>" {
+		t.Errorf("Got sender %q and raw sender %q", sender, rawSender)
+	}
+	expected := []string{"first@example.com", "second@example.com"}
+	if !reflect.DeepEqual(recipients, expected) {
+		t.Errorf("Got recipients %q, expected %q", recipients, expected)
+	}
+}
+
+func TestModifierTrackedHeaders(t *testing.T) {
+	var subjects, received []string
+	var count int
+	milter := &hookMilter{
+		body: func(m *Modifier) (Response, error) {
+			m.ChangeHeader(1, "subject", "Changed")
+			m.ChangeHeader(2, "Received", "")
+			m.AddHeader("X-Spam", "no")
+			m.ChangeHeader(1, "X-New", "added")
+			subjects, received = m.Headers["Subject"], m.Headers["Received"]
+			count = m.HeaderCount("x-spam") + m.HeaderCount("X-New")
+			return RespAccept, nil
+		},
+	}
+	session, sock, _ := newTestSession(milter, OptAddHeader|OptChangeHeader, 0)
+	sock.send('L', cstrings("Subject", "Original"))
+	sock.send('L', cstrings("Received", "from a"))
+	sock.send('L', cstrings("Received", "from b"))
+	sock.send('L', cstrings("Received", "from c"))
+	sock.send('N', nil)
+	sock.send('E', nil)
+	session.HandleMilterCommands()
+
+	if !reflect.DeepEqual(subjects, []string{"Changed"}) {
+		t.Errorf("Got Subject %q", subjects)
+	}
+	if !reflect.DeepEqual(received, []string{"from a", "from c"}) {
+		t.Errorf("Got Received %q", received)
+	}
+	if count != 2 {
+		t.Errorf("Expected added headers to be counted, got %d", count)
+	}
+}
+
+func TestRecipientsDecidedAtEOM(t *testing.T) {
+	milter := &hookMilter{
+		body: func(m *Modifier) (Response, error) {
+			// keep the first two recipients only
+			recipients := m.Recipients()
+			for _, rcpt := range recipients[2:] {
+				if err := m.DeleteRecipient(rcpt); err != nil {
+					return nil, err
+				}
+			}
+			return RespAccept, nil
+		},
+	}
+	session, sock, _ := newTestSession(milter, OptRemoveRcpt, 0)
+	sock.send('M', cstrings("<from@example.com>"))
+	for _, rcpt := range []string{"a", "b", "c", "d"} {
+		sock.send('R', cstrings("<"+rcpt+"@example.com>"))
+	}
+	sock.send('E', nil)
+	session.HandleMilterCommands()
+
+	replies := sock.replies(t)
+	var codes []byte
+	var deleted []string
+	for _, msg := range replies {
+		codes = append(codes, msg.Code)
+		if msg.Code == '-' {
+			deleted = append(deleted, readCString(msg.Data))
+		}
+	}
+	if string(codes) != "ccccc--a" {
+		t.Errorf("Got replies %q", codes)
+	}
+	if !reflect.DeepEqual(deleted, []string{"<c@example.com>", "<d@example.com>"}) {
+		t.Errorf("Got deleted recipients %q", deleted)
+	}
+}
+
+func TestModifierOriginalHeaderName(t *testing.T) {
+	var original, missing string
+	milter := &hookMilter{
+		headers: func(h textproto.MIMEHeader, m *Modifier) (Response, error) {
+			original, missing = m.OriginalHeaderName("Content-Type"), m.OriginalHeaderName("X-Missing")
+			return RespContinue, nil
+		},
+	}
+	session, sock, _ := newTestSession(milter, 0, 0)
+	sock.send('L', cstrings("Subject", "test"))
+	sock.send('L', cstrings("content-TYPE", "text/plain"))
+	sock.send('N', nil)
+	session.HandleMilterCommands()
+
+	if original != "content-TYPE" {
+		t.Errorf("Got original header name %q", original)
+	}
+	if missing != "" {
+		t.Errorf("Expected no name for missing header, got %q", missing)
+	}
+}
+
+func TestModifierReplaceBodyLazy(t *testing.T) {
+	tests := []struct {
+		name    string
+		replace func(m *Modifier)
+		codes   string
+		body    string
+	}{
+		{"unchanged", func(m *Modifier) {}, "cca", ""},
+		{"empty", func(m *Modifier) { m.ReplaceBody(nil) }, "cca", ""},
+		{"replaced", func(m *Modifier) {
+			m.ReplaceBody([]byte("new "))
+			m.ReplaceBody([]byte("body"))
+		}, "ccba", "new body"},
+	}
+	for _, test := range tests {
+		milter := &hookMilter{
+			body: func(m *Modifier) (Response, error) {
+				test.replace(m)
+				return RespAccept, nil
+			},
+		}
+		session, sock, _ := newTestSession(milter, OptChangeBody, 0)
+		sock.send('B', []byte("old "))
+		sock.send('B', []byte("body"))
+		sock.send('E', nil)
+		session.HandleMilterCommands()
+
+		replies := sock.replies(t)
+		var codes []byte
+		var body string
+		for _, msg := range replies {
+			codes = append(codes, msg.Code)
+			if msg.Code == 'b' {
+				body += string(msg.Data)
+			}
+		}
+		if string(codes) != test.codes || body != test.body {
+			t.Errorf("%s: got replies %q with body %q", test.name, codes, body)
+		}
+	}
+}
+
+func TestModifierReplaceBodyRejected(t *testing.T) {
+	for _, resp := range []Response{RespReject, RespTempFail, RespDiscard} {
+		milter := &hookMilter{
+			body: func(m *Modifier) (Response, error) {
+				m.ReplaceBody([]byte("new body"))
+				return resp, nil
+			},
+		}
+		session, sock, _ := newTestSession(milter, OptChangeBody, 0)
+		sock.send('B', []byte("old body"))
+		sock.send('E', nil)
+		session.HandleMilterCommands()
+
+		expected := "c" + string(resp.Response().Code)
+		if codes := sock.codes(t); codes != expected {
+			t.Errorf("%c: expected replies %q without the body, got %q", resp.Response().Code, expected, codes)
+		}
+	}
+
+	// a failed Body does not leave the body for the next message
+	session, _, _ := newTestSession(&hookMilter{
+		body: func(m *Modifier) (Response, error) {
+			m.ReplaceBody([]byte("new body"))
+			return nil, ErrCloseSession
+		},
+	}, OptChangeBody, 0)
+	session.Process(&Message{'E', nil})
+	if session.newBody != nil {
+		t.Errorf("Expected the new body to be dropped, got %q", session.newBody)
+	}
+}
+
+func TestModifierEnvelopeStruct(t *testing.T) {
+	var envelope *Envelope
+	milter := &hookMilter{
+		body: func(m *Modifier) (Response, error) {
+			envelope = m.Envelope()
+			return RespAccept, nil
+		},
+	}
+	session, sock, _ := newTestSession(milter, 0, 0)
+	sock.send('D', append([]byte{'C'}, cstrings("j", "mx.example.com")...))
+	sock.send('C', connectData("client.example.org", '4', 2525, "192.0.2.1"))
+	sock.send('H', cstrings("client.example.org"))
+	sock.send('D', append([]byte{'M'}, cstrings("i", "4ABC123", "{auth_authen}", "user")...))
+	sock.send('M', cstrings("<from@example.org>"))
+	sock.send('R', cstrings("<to@example.com>"))
+	sock.send('E', nil)
+	session.HandleMilterCommands()
+
+	expected := &Envelope{
+		Host:       "client.example.org",
+		Family:     "tcp4",
+		Port:       2525,
+		Addr:       net.ParseIP("192.0.2.1"),
+		Helo:       "client.example.org",
+		Sender:     "from@example.org",
+		Recipients: []string{"to@example.com"},
+		QueueID:    "4ABC123",
+		Macros:     map[string]string{"j": "mx.example.com", "i": "4ABC123", "{auth_authen}": "user"},
+	}
+	if !reflect.DeepEqual(envelope, expected) {
+		t.Errorf("Got envelope %+v, expected %+v", envelope, expected)
+	}
+}
+
+func TestModifierMacro(t *testing.T) {
+	type result struct {
+		value string
+		ok    bool
+	}
+	results := map[string]result{}
+	milter := &hookMilter{
+		mailFrom: func(from string, args []string, m *Modifier) (Response, error) {
+			for _, name := range []string{"i", "{i}", "auth_authen", "{auth_authen}", "cert_subject"} {
+				value, ok := m.Macro(name)
+				results[name] = result{value, ok}
+			}
+			return RespContinue, nil
+		},
+	}
+	session, sock, _ := newTestSession(milter, 0, 0)
+	sock.send('D', append([]byte{'M'}, cstrings("i", "4ABC123", "{auth_authen}", "user")...))
+	sock.send('M', cstrings("<from@example.com>"))
+	session.HandleMilterCommands()
+
+	expected := map[string]result{
+		"i":             {"4ABC123", true},
+		"{i}":           {"4ABC123", true},
+		"auth_authen":   {"user", true},
+		"{auth_authen}": {"user", true},
+		"cert_subject":  {"", false},
+	}
+	if !reflect.DeepEqual(results, expected) {
+		t.Errorf("Got macros %v, expected %v", results, expected)
+	}
+}
+
+func TestModifierStageMacro(t *testing.T) {
+	var got []string
+	milter := &hookMilter{
+		rcptTo: func(rcpt string, args []string, m *Modifier) (Response, error) {
+			addr, _ := m.StageMacro('R', "rcpt_addr")
+			connect, _ := m.StageMacro('C', "{j}")
+			mail, _ := m.StageMacro('M', "j")
+			flat, _ := m.Macro("j")
+			_, ok := m.StageMacro('H', "j")
+			got = append(got, fmt.Sprint(addr, " ", connect, " ", mail, " ", flat, " ", ok))
+			return RespContinue, nil
+		},
+	}
+	session, sock, _ := newTestSession(milter, 0, 0)
+	sock.send('D', append([]byte{'C'}, cstrings("j", "mx.example.com")...))
+	sock.send('C', connectData("localhost", '4', 25, "127.0.0.1"))
+	sock.send('D', append([]byte{'M'}, cstrings("j", "other.example.com")...))
+	sock.send('M', cstrings("<from@example.com>"))
+	for _, rcpt := range []string{"a@example.com", "b@example.com"} {
+		sock.send('D', append([]byte{'R'}, cstrings("{rcpt_addr}", rcpt)...))
+		sock.send('R', cstrings("<"+rcpt+">"))
+	}
+	session.HandleMilterCommands()
+
+	expected := []string{
+		"a@example.com mx.example.com other.example.com other.example.com false",
+		"b@example.com mx.example.com other.example.com other.example.com false",
+	}
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("Got macros %q, expected %q", got, expected)
+	}
+}
+
+func TestModifierQuarantine(t *testing.T) {
+	tests := []struct {
+		actions OptAction
+		err     error
+		codes   string
+	}{
+		{OptQuarantine, nil, "qa"},
+		{OptAddHeader, ErrActionNotNegotiated, "a"},
+	}
+	for _, test := range tests {
+		var err error
+		milter := &hookMilter{
+			body: func(m *Modifier) (Response, error) {
+				err = m.Quarantine("suspicious attachment")
+				return RespAccept, nil
+			},
+		}
+		session, sock, _ := newTestSession(milter, test.actions, 0)
+		sock.send('E', nil)
+		session.HandleMilterCommands()
+
+		if err != test.err {
+			t.Errorf("Actions %#x: got error %v, expected %v", test.actions, err, test.err)
+		}
+		replies := sock.replies(t)
+		var codes []byte
+		for _, msg := range replies {
+			codes = append(codes, msg.Code)
+		}
+		if string(codes) != test.codes {
+			t.Errorf("Actions %#x: got replies %q", test.actions, codes)
+		}
+		if test.err == nil && string(replies[0].Data) != "suspicious attachment\x00" {
+			t.Errorf("Got quarantine reason %q", replies[0].Data)
+		}
+	}
+}
+
+func TestModifierProgress(t *testing.T) {
+	milter := &hookMilter{
+		body: func(m *Modifier) (Response, error) {
+			for i := 0; i < 3; i++ {
+				if err := m.Progress(); err != nil {
+					return nil, err
+				}
+			}
+			return RespAccept, nil
+		},
+	}
+	session, sock, _ := newTestSession(milter, 0, 0)
+	sock.send('E', nil)
+	session.HandleMilterCommands()
+
+	if codes := sock.codes(t); codes != "pppa" {
+		t.Errorf("Expected progress before final response, got %q", codes)
+	}
+}
+
+func TestModifierDelay(t *testing.T) {
+	milter := &hookMilter{
+		helo: func(name string, m *Modifier) (Response, error) {
+			switch name {
+			case "slow":
+				m.Delay(50 * time.Millisecond)
+			case "abuser":
+				m.Delay(time.Hour)
+			}
+			return RespContinue, nil
+		},
+	}
+	conn, clientConn := net.Pipe()
+	session := &milterSession{sock: conn, milter: milter, logger: &testLogger{}}
+	done := make(chan struct{})
+	go func() {
+		session.HandleMilterCommands()
+		close(done)
+	}()
+	client := &milterSession{sock: clientConn}
+
+	start := time.Now()
+	if msg, err := exchange(client, 'H', cstrings("slow")); err != nil || msg.Code != 'c' {
+		t.Fatalf("Expected continue, got %v %v", msg, err)
+	}
+	if elapsed := time.Since(start); elapsed < 50*time.Millisecond {
+		t.Errorf("Expected reply to be delayed, got it after %v", elapsed)
+	}
+	if msg, err := exchange(client, 'H', cstrings("fast")); err != nil || msg.Code != 'c' {
+		t.Fatalf("Expected continue, got %v %v", msg, err)
+	}
+
+	// closing the connection ends the delay
+	if err := client.WritePacket(&Message{'H', cstrings("abuser")}); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(20 * time.Millisecond)
+	clientConn.Close()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected delay to end when the connection is closed")
+	}
+}
+
+func TestModifierBodySize(t *testing.T) {
+	var sizes []int64
+	milter := &hookMilter{
+		body: func(m *Modifier) (Response, error) {
+			sizes = append(sizes, m.BodySize())
+			return RespAccept, nil
+		},
+	}
+	session, sock, _ := newTestSession(milter, 0, 0)
+	sock.send('M', cstrings("<from@example.com>"))
+	for i := 0; i < 3; i++ {
+		sock.send('B', make([]byte, 65535))
+	}
+	sock.send('B', []byte("end\r\n"))
+	sock.send('E', nil)
+	sock.send('M', cstrings("<from@example.com>"))
+	sock.send('B', []byte("short\r\n"))
+	sock.send('E', nil)
+	session.HandleMilterCommands()
+
+	if !reflect.DeepEqual(sizes, []int64{3*65535 + 5, 7}) {
+		t.Errorf("Got body sizes %v", sizes)
+	}
+}
+
+func TestModifierAddRecipientWithArgs(t *testing.T) {
+	tests := []struct {
+		actions OptAction
+		err     error
+		codes   string
+	}{
+		{OptAddRcpt | OptAddRcptPartial, nil, "2+a"},
+		{OptAddRcpt, ErrActionNotNegotiated, "+a"},
+	}
+	for _, test := range tests {
+		var err error
+		milter := &hookMilter{
+			body: func(m *Modifier) (Response, error) {
+				err = m.AddRecipientWithArgs("a@example.com", "NOTIFY=NEVER")
+				m.AddRecipient("b@example.com")
+				return RespAccept, nil
+			},
+		}
+		session, sock, _ := newTestSession(milter, test.actions, 0)
+		sock.send('E', nil)
+		session.HandleMilterCommands()
+
+		if err != test.err {
+			t.Errorf("Actions %#x: got error %v, expected %v", test.actions, err, test.err)
+		}
+		replies := sock.replies(t)
+		if codes := sock.codes(t); codes != test.codes {
+			t.Errorf("Actions %#x: got replies %q", test.actions, codes)
+		}
+		if test.err == nil && string(replies[0].Data) != "<a@example.com>\x00NOTIFY=NEVER\x00" {
+			t.Errorf("Got recipient data %q", replies[0].Data)
+		}
+	}
+}
+
+func TestModifierChangeFromWithArgs(t *testing.T) {
+	tests := []struct {
+		actions OptAction
+		err     error
+		codes   string
+	}{
+		{OptChangeFrom, nil, "ea"},
+		{OptAddHeader, ErrActionNotNegotiated, "a"},
+	}
+	for _, test := range tests {
+		var err error
+		milter := &hookMilter{
+			body: func(m *Modifier) (Response, error) {
+				err = m.ChangeFromWithArgs("<bounce@example.com>", "BODY=8BITMIME")
+				return RespAccept, nil
+			},
+		}
+		session, sock, _ := newTestSession(milter, test.actions, 0)
+		sock.send('E', nil)
+		session.HandleMilterCommands()
+
+		if err != test.err {
+			t.Errorf("Actions %#x: got error %v, expected %v", test.actions, err, test.err)
+		}
+		replies := sock.replies(t)
+		if codes := sock.codes(t); codes != test.codes {
+			t.Errorf("Actions %#x: got replies %q", test.actions, codes)
+		}
+		if test.err == nil && string(replies[0].Data) != "<bounce@example.com>\x00BODY=8BITMIME\x00" {
+			t.Errorf("Got sender data %q", replies[0].Data)
+		}
+	}
+}
+
+func TestModifierActionsNotNegotiated(t *testing.T) {
+	calls := map[string]func(m *Modifier) error{
+		"AddRecipient":    func(m *Modifier) error { return m.AddRecipient("a@example.com") },
+		"DeleteRecipient": func(m *Modifier) error { return m.DeleteRecipient("a@example.com") },
+		"ReplaceBody":     func(m *Modifier) error { return m.ReplaceBody([]byte("body")) },
+		"AddHeader":       func(m *Modifier) error { return m.AddHeader("X-Test", "1") },
+		"ChangeHeader":    func(m *Modifier) error { return m.ChangeHeader(1, "X-Test", "1") },
+		"InsertHeader":    func(m *Modifier) error { return m.InsertHeader(1, "X-Test", "1") },
+		"ChangeFrom":      func(m *Modifier) error { return m.ChangeFrom("<a@example.com>") },
+	}
+	for name, call := range calls {
+		var err error
+		milter := &hookMilter{
+			body: func(m *Modifier) (Response, error) {
+				err = call(m)
+				return RespAccept, nil
+			},
+		}
+		session, sock, _ := newTestSession(milter, OptQuarantine, 0)
+		sock.send('E', nil)
+		session.HandleMilterCommands()
+
+		if err != ErrActionNotNegotiated {
+			t.Errorf("%s: expected ErrActionNotNegotiated, got %v", name, err)
+		}
+		if codes := sock.codes(t); codes != "a" {
+			t.Errorf("%s: expected no modification to be sent, got %q", name, codes)
+		}
+	}
+}
+
+func TestModifierActionsNotOffered(t *testing.T) {
+	var err error
+	milter := &hookMilter{
+		body: func(m *Modifier) (Response, error) {
+			err = m.AddHeader("X-Test", "1")
+			return RespAccept, nil
+		},
+	}
+	// the milter asks for more than the MTA offers
+	session, sock, _ := newTestSession(milter, OptAddHeader|OptChangeFrom, 0)
+	sock.send('O', optneg(6, OptChangeFrom, 0))
+	sock.send('E', nil)
+	session.HandleMilterCommands()
+
+	if err != ErrActionNotNegotiated {
+		t.Errorf("Expected ErrActionNotNegotiated, got %v", err)
+	}
+	if codes := sock.codes(t); codes != "Oa" {
+		t.Errorf("Expected no modification to be sent, got %q", codes)
+	}
+}
+
+func TestModifierSetSymList(t *testing.T) {
+	var errs []error
+	milter := &negotiateMilter{
+		negotiate: func(m *Modifier) {
+			errs = append(errs,
+				m.SetSymList(SymListMailFrom, []string{"{auth_authen}", "i"}),
+				m.SetSymList(SymListConnect, []string{"j"}),
+				m.SetSymList(SymListEOH+1, []string{"j"}))
+		},
+	}
+	milter.body = func(m *Modifier) (Response, error) {
+		errs = append(errs, m.SetSymList(SymListEOM, []string{"i"}))
+		return RespAccept, nil
+	}
+	session, sock, _ := newTestSession(milter, OptAddHeader, 0)
+	sock.send('O', optneg(6, OptAddHeader|OptSetSymList, 0))
+	sock.send('E', nil)
+	session.HandleMilterCommands()
+
+	expectedErrs := []error{nil, nil, ErrInvalidSymListStage, ErrNotNegotiating}
+	if !reflect.DeepEqual(errs, expectedErrs) {
+		t.Errorf("Got errors %v, expected %v", errs, expectedErrs)
+	}
+	// lists follow the options in stage order
+	expected := optneg(6, OptAddHeader|OptSetSymList, 0)
+	expected = append(expected, 0, 0, 0, SymListConnect)
+	expected = append(expected, "j\x00"...)
+	expected = append(expected, 0, 0, 0, SymListMailFrom)
+	expected = append(expected, "{auth_authen} i\x00"...)
+	if replies := sock.replies(t); !bytes.Equal(replies[0].Data, expected) {
+		t.Errorf("Got negotiation reply %q, expected %q", replies[0].Data, expected)
+	}
+
+	// the MTA has to offer macro lists
+	errs = nil
+	milter.body = nil
+	session, sock, _ = newTestSession(milter, OptAddHeader, 0)
+	sock.send('O', optneg(6, OptAddHeader, 0))
+	session.HandleMilterCommands()
+	if errs[0] != ErrActionNotNegotiated {
+		t.Errorf("Expected ErrActionNotNegotiated, got %v", errs[0])
+	}
+	if replies := sock.replies(t); !bytes.Equal(replies[0].Data, optneg(6, OptAddHeader, 0)) {
+		t.Errorf("Expected no macro lists, got %q", replies[0].Data)
+	}
+}
+
+func TestModifierBodyReader(t *testing.T) {
+	var bodies []string
+	milter := &hookMilter{
+		body: func(m *Modifier) (Response, error) {
+			body, err := ioutil.ReadAll(m.BodyReader())
+			bodies = append(bodies, string(body))
+			return RespAccept, err
+		},
+	}
+	session, sock, _ := newTestSession(milter, 0, 0)
+	session.bufferBody = true
+	for _, chunks := range [][]string{{"first ", "message"}, {"second"}} {
+		sock.send('M', cstrings("<from@example.com>"))
+		for _, chunk := range chunks {
+			sock.send('B', []byte(chunk))
+		}
+		sock.send('E', nil)
+	}
+	session.HandleMilterCommands()
+
+	if expected := []string{"first message", "second"}; !reflect.DeepEqual(bodies, expected) {
+		t.Errorf("Got bodies %q, expected %q", bodies, expected)
+	}
+}
+
+func TestModifierBodyReaderLimit(t *testing.T) {
+	milter := &hookMilter{}
+	session, sock, logger := newTestSession(milter, 0, 0)
+	session.bufferBody = true
+	session.maxBodySize = 5
+	sock.send('B', []byte("123"))
+	sock.send('B', []byte("456"))
+	sock.send('B', []byte("789"))
+	sock.send('E', nil)
+	session.HandleMilterCommands()
+
+	if codes := sock.codes(t); codes != "ctct" {
+		t.Errorf("Expected tempfail once the body is too large, got %q", codes)
+	}
+	for _, call := range milter.calls {
+		if call == "Body" {
+			t.Error("Body called for a body that was too large")
+		}
+	}
+	if !logger.contains("Body exceeds 5 bytes") {
+		t.Errorf("Expected oversized body to be logged, got %q", logger.lines)
+	}
+}
+
+func TestModifierConnectionInfo(t *testing.T) {
+	var helo, host string
+	var addr net.IP
+	milter := &hookMilter{
+		mailFrom: func(from string, args []string, m *Modifier) (Response, error) {
+			helo, host, addr = m.Helo(), m.ConnectHost(), m.ConnectAddr()
+			return RespContinue, nil
+		},
+	}
+	session, sock, _ := newTestSession(milter, 0, 0)
+	sock.send('C', connectData("mail.example.com", '4', 4321, "192.0.2.1"))
+	sock.send('H', cstrings("first.example.com"))
+	sock.send('H', cstrings("second.example.com"))
+	sock.send('M', cstrings("<from@example.com>"))
+	session.HandleMilterCommands()
+
+	if helo != "second.example.com" {
+		t.Errorf("Got HELO name %q", helo)
+	}
+	if host != "mail.example.com" || !addr.Equal(net.ParseIP("192.0.2.1")) {
+		t.Errorf("Got host %q and address %v", host, addr)
+	}
+}
+
+func TestModifierHeaderLeadSpace(t *testing.T) {
+	tests := []struct {
+		name     string
+		protocol OptProtocol
+		expected []string
+	}{
+		{"plain", 0, []string{"X-A\x00one\x00", "\x00\x00\x00\x01X-B\x00 two\x00", "\x00\x00\x00\x01X-C\x00\x00"}},
+		{"lead space", OptHdrLeadSpace, []string{"X-A\x00 one\x00", "\x00\x00\x00\x01X-B\x00 two\x00", "\x00\x00\x00\x01X-C\x00\x00"}},
+	}
+	for _, test := range tests {
+		milter := &hookMilter{
+			body: func(m *Modifier) (Response, error) {
+				m.AddHeader("X-A", "one")
+				m.InsertHeader(1, "X-B", " two")
+				m.ChangeHeader(1, "X-C", "")
+				return RespAccept, nil
+			},
+		}
+		session, sock, _ := newTestSession(milter, OptAddHeader|OptChangeHeader, test.protocol)
+		sock.send('O', optneg(6, OptAllActions, OptHdrLeadSpace))
+		sock.send('E', nil)
+		session.HandleMilterCommands()
+
+		var data []string
+		for _, msg := range sock.replies(t)[1:4] {
+			data = append(data, string(msg.Data))
+		}
+		if !reflect.DeepEqual(data, test.expected) {
+			t.Errorf("%s: got header data %q, expected %q", test.name, data, test.expected)
+		}
+	}
+}
+
+func TestModifierDeleteHeaderByName(t *testing.T) {
+	var remaining textproto.MIMEHeader
+	milter := &hookMilter{
+		body: func(m *Modifier) (Response, error) {
+			if err := m.DeleteHeaderByName("received"); err != nil {
+				return nil, err
+			}
+			remaining = m.Headers
+			return RespAccept, nil
+		},
+	}
+	session, sock, _ := newTestSession(milter, OptChangeHeader, 0)
+	sock.send('L', cstrings("Received", "from a"))
+	sock.send('L', cstrings("Subject", "Hello"))
+	sock.send('L', cstrings("Received", "from b"))
+	sock.send('L', cstrings("Received", "from c"))
+	sock.send('E', nil)
+	session.HandleMilterCommands()
+
+	var indexes []uint32
+	for _, msg := range sock.replies(t) {
+		if msg.Code == 'm' {
+			indexes = append(indexes, binary.BigEndian.Uint32(msg.Data))
+			if !bytes.Equal(msg.Data[4:], []byte("received\x00\x00")) {
+				t.Errorf("Got header change %q", msg.Data[4:])
+			}
+		}
+	}
+	if expected := []uint32{3, 2, 1}; !reflect.DeepEqual(indexes, expected) {
+		t.Errorf("Expected deletes in descending order, got %v", indexes)
+	}
+	if expected := (textproto.MIMEHeader{"Subject": {"Hello"}}); !reflect.DeepEqual(remaining, expected) {
+		t.Errorf("Got remaining headers %v", remaining)
+	}
+
+	// nothing is sent unless OptChangeHeader was negotiated
+	session, sock, _ = newTestSession(milter, OptAddHeader, 0)
+	sock.send('L', cstrings("Received", "from a"))
+	sock.send('E', nil)
+	session.HandleMilterCommands()
+	if codes := sock.codes(t); codes != "c" {
+		t.Errorf("Expected session to be closed without changes, got %q", codes)
+	}
+}
+
+func TestModifierReplaceBodyReader(t *testing.T) {
+	body := bytes.Repeat([]byte("0123456789abcdef"), 600*1024/16)
+	milter := &hookMilter{
+		body: func(m *Modifier) (Response, error) {
+			if err := m.ReplaceBody([]byte("disclaimer\r\n")); err != nil {
+				return nil, err
+			}
+			return RespAccept, m.ReplaceBodyReader(bytes.NewReader(body))
+		},
+	}
+	session, sock, _ := newTestSession(milter, OptChangeBody, OptMDS256K)
+	sock.send('O', optneg(6, OptAllActions, OptMDS256K))
+	sock.send('E', nil)
+	session.HandleMilterCommands()
+
+	var sizes []int
+	var replaced []byte
+	for _, msg := range sock.replies(t) {
+		if msg.Code == 'b' {
+			sizes = append(sizes, len(msg.Data))
+			replaced = append(replaced, msg.Data...)
+		}
+	}
+	if expected := []int{12, 256 * 1024, 256 * 1024, 88 * 1024}; !reflect.DeepEqual(sizes, expected) {
+		t.Errorf("Got body packets of %v bytes, expected %v", sizes, expected)
+	}
+	if !bytes.Equal(replaced, append([]byte("disclaimer\r\n"), body...)) {
+		t.Error("Replaced body does not match")
+	}
+	if codes := sock.codes(t); codes[len(codes)-1] != 'a' {
+		t.Errorf("Expected final accept, got %q", codes)
+	}
+}
+
+func TestModifierMaxDataSize(t *testing.T) {
+	body := bytes.Repeat([]byte("x"), 512*1024)
+	var errs []error
+	milter := &hookMilter{
+		body: func(m *Modifier) (Response, error) {
+			long := string(body[:300*1024])
+			errs = append(errs,
+				m.AddHeader("X-Long", long),
+				m.InsertHeader(1, "X-Long", long),
+				m.ChangeHeader(1, "X-Long", long),
+				m.ReplaceBody(body))
+			return RespAccept, nil
+		},
+	}
+	session, sock, _ := newTestSession(milter, OptAddHeader|OptChangeHeader|OptChangeBody, OptMDS256K)
+	sock.send('O', optneg(6, OptAllActions, OptMDS256K))
+	sock.send('E', nil)
+	session.HandleMilterCommands()
+
+	expected := []error{ErrPacketTooLarge, ErrPacketTooLarge, ErrPacketTooLarge, nil}
+	if !reflect.DeepEqual(errs, expected) {
+		t.Errorf("Got errors %v, expected %v", errs, expected)
+	}
+	var sizes []int
+	for _, msg := range sock.replies(t)[1:] {
+		if msg.Code == 'b' {
+			sizes = append(sizes, len(msg.Data))
+		}
+	}
+	if expected := []int{256 * 1024, 256 * 1024}; !reflect.DeepEqual(sizes, expected) {
+		t.Errorf("Got body packets of %v bytes, expected %v", sizes, expected)
+	}
+	if codes := sock.codes(t); codes != "Obba" {
+		t.Errorf("Expected only the body to be sent, got %q", codes)
+	}
+}
+
+func TestModifierAppendBody(t *testing.T) {
+	tests := []struct {
+		name   string
+		modify func(m *Modifier) error
+		body   string
+	}{
+		{"string", func(m *Modifier) error { return m.ReplaceBodyString("new body") }, "new body"},
+		{"append", func(m *Modifier) error { return m.AppendBody([]byte("\r\n-- \r\nfooter")) }, "old body\r\n-- \r\nfooter"},
+		{"prepend", func(m *Modifier) error { return m.PrependBody([]byte("header\r\n")) }, "header\r\nold body"},
+		{"replaced", func(m *Modifier) error {
+			m.ReplaceBody([]byte("new"))
+			return m.AppendBody([]byte(" footer"))
+		}, "new footer"},
+	}
+	for _, test := range tests {
+		var err error
+		milter := &hookMilter{
+			body: func(m *Modifier) (Response, error) {
+				err = test.modify(m)
+				return RespAccept, nil
+			},
+		}
+		session, sock, _ := newTestSession(milter, OptChangeBody, 0)
+		session.bufferBody = true
+		sock.send('B', []byte("old "))
+		sock.send('B', []byte("body"))
+		sock.send('E', nil)
+		session.HandleMilterCommands()
+
+		var body string
+		for _, msg := range sock.replies(t) {
+			if msg.Code == 'b' {
+				body += string(msg.Data)
+			}
+		}
+		if err != nil || body != test.body {
+			t.Errorf("%s: got body %q, error %v", test.name, body, err)
+		}
+	}
+
+	// appending needs the original body
+	var err error
+	milter := &hookMilter{
+		body: func(m *Modifier) (Response, error) {
+			err = m.AppendBody([]byte("footer"))
+			return RespAccept, nil
+		},
+	}
+	session, sock, _ := newTestSession(milter, OptChangeBody, 0)
+	sock.send('B', []byte("body"))
+	sock.send('E', nil)
+	session.HandleMilterCommands()
+	if err != ErrBodyNotBuffered {
+		t.Errorf("Expected ErrBodyNotBuffered, got %v", err)
+	}
+}
+
+func TestModifierInvalidHeader(t *testing.T) {
+	tests := []struct {
+		name, value string
+		err         error
+	}{
+		{"X-Test", "value", nil},
+		{"X-Test", "folded\r\n\tvalue", nil},
+		{"X-Test", "folded\n value", nil},
+		{"", "value", ErrInvalidHeader},
+		{"X-Test:", "value", ErrInvalidHeader},
+		{"X Test", "value", ErrInvalidHeader},
+		{"X-Test\r\nBcc", "value", ErrInvalidHeader},
+		{"X-Tëst", "value", ErrInvalidHeader},
+		{"X-Test", "value\r\nBcc: victim@example.com", ErrInvalidHeader},
+		{"X-Test", "value\nBcc: victim@example.com", ErrInvalidHeader},
+		{"X-Test", "value\rmore", ErrInvalidHeader},
+		{"X-Test", "value\r\n", ErrInvalidHeader},
+		{"X-Test", "value\x00more", ErrInvalidHeader},
+	}
+	for _, test := range tests {
+		var errs []error
+		milter := &hookMilter{
+			body: func(m *Modifier) (Response, error) {
+				errs = append(errs, m.AddHeader(test.name, test.value))
+				errs = append(errs, m.InsertHeader(1, test.name, test.value))
+				errs = append(errs, m.ChangeHeader(1, test.name, test.value))
+				return RespAccept, nil
+			},
+		}
+		session, sock, _ := newTestSession(milter, OptAddHeader|OptChangeHeader, 0)
+		sock.send('E', nil)
+		session.HandleMilterCommands()
+
+		for _, err := range errs {
+			if err != test.err {
+				t.Errorf("%q: %q: expected %v, got %v", test.name, test.value, test.err, err)
+			}
+		}
+		if codes := sock.codes(t); test.err != nil && codes != "a" {
+			t.Errorf("%q: %q: expected no modifications, got %q", test.name, test.value, codes)
+		}
+	}
+}
+
+func TestModifierInsertHeaderIndex(t *testing.T) {
+	var errs []error
+	milter := &hookMilter{
+		body: func(m *Modifier) (Response, error) {
+			errs = append(errs,
+				m.InsertHeader(0, "X-First", "value"),
+				m.InsertHeader(2, "X-Second", "value"),
+				m.InsertHeader(-1, "X-Negative", "value"),
+				m.ChangeHeader(-1, "Subject", "value"),
+			)
+			return RespAccept, nil
+		},
+	}
+	session, sock, _ := newTestSession(milter, OptAddHeader|OptChangeHeader, 0)
+	sock.send('L', cstrings("Subject", "Test"))
+	sock.send('L', cstrings("From", "from@example.com"))
+	sock.send('L', cstrings("To", "to@example.com"))
+	sock.send('N', nil)
+	sock.send('E', nil)
+	session.HandleMilterCommands()
+
+	expected := []error{nil, nil, ErrInvalidHeaderIndex, ErrInvalidHeaderIndex}
+	if !reflect.DeepEqual(errs, expected) {
+		t.Errorf("Expected %v, got %v", expected, errs)
+	}
+	// index 0 is sent as is to prepend, index N inserts after the Nth header
+	var indices []uint32
+	var names []string
+	var codes []byte
+	for _, msg := range sock.replies(t) {
+		codes = append(codes, msg.Code)
+		if msg.Code == 'i' {
+			indices = append(indices, binary.BigEndian.Uint32(msg.Data))
+			names = append(names, readCString(msg.Data[4:]))
+		}
+	}
+	if string(codes) != "cccciia" {
+		t.Errorf("Got replies %q", codes)
+	}
+	if !reflect.DeepEqual(indices, []uint32{0, 2}) {
+		t.Errorf("Got header indices %v", indices)
+	}
+	if !reflect.DeepEqual(names, []string{"X-First", "X-Second"}) {
+		t.Errorf("Got inserted headers %q", names)
+	}
+}
+
+func TestModifierBatch(t *testing.T) {
+	var errs []error
+	var queued, sent int
+	var sock *bufferSock
+	milter := &hookMilter{
+		body: func(m *Modifier) (Response, error) {
+			before := sock.out.Len()
+			err := m.Batch(func(b *ModBatch) {
+				errs = append(errs,
+					b.AddHeader("X-First", "1"),
+					b.AddHeader("X-Test:", "invalid"),
+					b.AddRecipient("rcpt@example.com"),
+					b.Progress(),
+					b.AddHeader("X-Second", "2"),
+				)
+				queued = sock.out.Len() - before
+			})
+			errs = append(errs, err)
+			sent = sock.out.Len() - before
+			return RespAccept, nil
+		},
+	}
+	session, s, _ := newTestSession(milter, OptAddHeader|OptAddRcpt, 0)
+	sock = s
+	sock.send('E', nil)
+	session.HandleMilterCommands()
+
+	expected := []error{nil, ErrInvalidHeader, nil, nil, nil, nil}
+	if !reflect.DeepEqual(errs, expected) {
+		t.Errorf("Expected %v, got %v", expected, errs)
+	}
+	// only the progress report is sent while the batch runs
+	if queued != 5 || sent <= queued {
+		t.Errorf("Expected modifications to be sent once the batch ends, got %d bytes during and %d after", queued, sent)
+	}
+	if codes := sock.codes(t); codes != "ph+ha" {
+		t.Errorf("Got replies %q", codes)
+	}
+}
+
+func TestModifierBatchWriteError(t *testing.T) {
+	var err error
+	var headers textproto.MIMEHeader
+	milter := &hookMilter{
+		body: func(m *Modifier) (Response, error) {
+			m.Progress()
+			err = m.Batch(func(b *ModBatch) {
+				b.AddHeader("X-Added", "1")
+				b.ChangeHeader(1, "Subject", "changed")
+			})
+			headers = m.Headers
+			return RespAccept, nil
+		},
+	}
+	// the reply to the header and the progress report are the last writes to succeed
+	sock := &shortWriter{max: 1 << 20, failAfter: 2}
+	session, _, _ := newTestSession(milter, OptAddHeader|OptChangeHeader, 0)
+	session.sock = sock
+	sock.send('L', cstrings("Subject", "original"))
+	sock.send('E', nil)
+	session.HandleMilterCommands()
+
+	if err != io.ErrClosedPipe {
+		t.Errorf("Expected write error, got %v", err)
+	}
+	// the MTA never got the modifications
+	if headers.Get("X-Added") != "" || headers.Get("Subject") != "original" {
+		t.Errorf("Expected unchanged headers, got %v", headers)
+	}
+}
+
+func TestModifierBatchAutoProgress(t *testing.T) {
+	milter := &hookMilter{
+		body: func(m *Modifier) (Response, error) {
+			m.Batch(func(b *ModBatch) {
+				b.AddHeader("X-First", "1")
+				time.Sleep(50 * time.Millisecond)
+				b.AddHeader("X-Second", "2")
+			})
+			return RespAccept, nil
+		},
+	}
+	session, sock, _ := newTestSession(milter, OptAddHeader, 0)
+	session.autoProgressInterval = 5 * time.Millisecond
+	sock.send('E', nil)
+	session.HandleMilterCommands()
+
+	// progress reports go out while the batch runs, ahead of its modifications
+	if codes := sock.codes(t); !regexp.MustCompile("^p+hhp*a$").MatchString(codes) {
+		t.Errorf("Got replies %q", codes)
+	}
+}
+
+func TestModifierBatchPanic(t *testing.T) {
+	milter := &hookMilter{
+		body: func(m *Modifier) (Response, error) {
+			func() {
+				defer func() { recover() }()
+				m.Batch(func(b *ModBatch) {
+					b.AddHeader("X-Dropped", "1")
+					panic("batch failed")
+				})
+			}()
+			m.AddHeader("X-Sent", "1")
+			return RespAccept, nil
+		},
+	}
+	session, sock, _ := newTestSession(milter, OptAddHeader, 0)
+	sock.send('E', nil)
+	session.HandleMilterCommands()
+
+	replies := sock.replies(t)
+	if len(replies) != 2 || replies[0].Code != 'h' || readCString(replies[0].Data) != "X-Sent" {
+		t.Errorf("Expected only the header added after the batch, got %v", replies)
+	}
+}
+
+func TestModifierClientPTR(t *testing.T) {
+	var ptr, resolve string
+	milter := &hookMilter{
+		connect: func(host string, family string, port uint16, addr net.IP, m *Modifier) (Response, error) {
+			ptr, resolve = m.ClientPTR(), m.ClientResolve()
+			return RespContinue, nil
+		},
+	}
+	session, sock, _ := newTestSession(milter, 0, 0)
+	sock.send('D', append([]byte{'C'}, cstrings("{client_ptr}", "mail.example.com", "{client_resolve}", "FORGED")...))
+	sock.send('C', connectData("[192.0.2.1]", '4', 4321, "192.0.2.1"))
+	session.HandleMilterCommands()
+
+	if ptr != "mail.example.com" || resolve != "FORGED" {
+		t.Errorf("Got PTR %q and resolve status %q in Connect", ptr, resolve)
+	}
+}
+
+func TestModifierChangeFromKeepsArgs(t *testing.T) {
+	tests := []struct {
+		name   string
+		change func(m *Modifier) error
+		data   string
+	}{
+		{"kept", func(m *Modifier) error { return m.ChangeFrom("<bounce@example.com>") }, "<bounce@example.com>\x00SIZE=1024 RET=HDRS\x00"},
+		{"replaced", func(m *Modifier) error { return m.ChangeFromWithArgs("<bounce@example.com>", "SIZE=1024") }, "<bounce@example.com>\x00SIZE=1024\x00"},
+	}
+	for _, test := range tests {
+		var args []string
+		var err error
+		milter := &hookMilter{
+			body: func(m *Modifier) (Response, error) {
+				args = m.SenderArgs()
+				err = test.change(m)
+				return RespAccept, nil
+			},
+		}
+		session, sock, _ := newTestSession(milter, OptChangeFrom, 0)
+		sock.send('M', cstrings("<from@example.com>", "SIZE=1024", "RET=HDRS"))
+		sock.send('E', nil)
+		session.HandleMilterCommands()
+
+		if !reflect.DeepEqual(args, []string{"SIZE=1024", "RET=HDRS"}) {
+			t.Errorf("%s: got sender args %q", test.name, args)
+		}
+		replies := sock.replies(t)
+		if err != nil || len(replies) != 3 || string(replies[1].Data) != test.data {
+			t.Errorf("%s: got replies %v, error %v", test.name, replies, err)
+		}
+	}
+}
+
+func TestModifierExpired(t *testing.T) {
+	var captured *Modifier
+	milter := &hookMilter{
+		rcptTo: func(rcptTo string, args []string, m *Modifier) (Response, error) {
+			captured = m
+			return RespContinue, nil
+		},
+		body: func(m *Modifier) (Response, error) {
+			if err := captured.AddHeader("X-Test", "late"); err != ErrModifierExpired {
+				t.Errorf("Expected ErrModifierExpired, got %v", err)
+			}
+			if err := captured.ReplaceBody([]byte("late")); err != ErrModifierExpired {
+				t.Errorf("Expected ErrModifierExpired, got %v", err)
+			}
+			return RespAccept, m.AddHeader("X-Test", "current")
+		},
+	}
+	session, sock, _ := newTestSession(milter, OptAddHeader|OptChangeBody, 0)
+	sock.send('R', cstrings("<to@example.com>"))
+	sock.send('E', nil)
+	session.HandleMilterCommands()
+
+	if codes := sock.codes(t); codes != "cha" {
+		t.Errorf("Expected only the current modification, got %q", codes)
+	}
+}
+
+func TestModifierRawHeaders(t *testing.T) {
+	var headers []RawHeader
+	milter := &hookMilter{
+		headers: func(h textproto.MIMEHeader, m *Modifier) (Response, error) {
+			headers = m.RawHeaders()
+			return RespContinue, nil
+		},
+	}
+	session, sock, _ := newTestSession(milter, 0, 0)
+	session.unfoldHeaders = true
+	sock.send('L', cstrings("DKIM-Signature", " v=1; a=rsa-sha256;\r\n\td=example.com"))
+	sock.send('L', cstrings("subject", "first"))
+	sock.send('L', cstrings("Received", "from a"))
+	sock.send('L', cstrings("SUBJECT", "second"))
+	sock.send('N', nil)
+	session.HandleMilterCommands()
+
+	expected := []RawHeader{
+		{"DKIM-Signature", " v=1; a=rsa-sha256;\r\n\td=example.com"},
+		{"subject", "first"},
+		{"Received", "from a"},
+		{"SUBJECT", "second"},
+	}
+	if !reflect.DeepEqual(headers, expected) {
+		t.Errorf("Got raw headers %q, expected %q", headers, expected)
+	}
+}
+
+func TestModifierAuthInfo(t *testing.T) {
+	var info AuthInfo
+	milter := &hookMilter{
+		mailFrom: func(from string, args []string, m *Modifier) (Response, error) {
+			info = m.AuthInfo()
+			return RespContinue, nil
+		},
+	}
+	session, sock, _ := newTestSession(milter, 0, 0)
+	sock.send('D', append([]byte{'M'}, cstrings("{auth_type}", "PLAIN", "{auth_authen}", "user@example.com", "{auth_ssf}", "")...))
+	sock.send('M', cstrings("<from@example.com>"))
+	session.HandleMilterCommands()
+
+	if expected := (AuthInfo{Type: "PLAIN", Authen: "user@example.com"}); info != expected {
+		t.Errorf("Got %+v, expected %+v", info, expected)
+	}
+}
+
+func TestModifierBodySizeLimit(t *testing.T) {
+	milter := &hookMilter{
+		bodyChunk: func(chunk []byte, m *Modifier) (Response, error) {
+			if m.BodySize() > 8 {
+				return RespReject, nil
+			}
+			return RespContinue, nil
+		},
+	}
+	session, sock, _ := newTestSession(milter, 0, 0)
+	sock.send('M', cstrings("<from@example.com>"))
+	sock.send('B', []byte("0123456789"))
+	sock.send('A', nil)
+	// the size of the aborted message does not count
+	sock.send('M', cstrings("<from@example.com>"))
+	sock.send('B', []byte("0123"))
+	sock.send('B', []byte("4567"))
+	sock.send('E', nil)
+	session.HandleMilterCommands()
+
+	if codes := sock.codes(t); codes != "crccca" {
+		t.Errorf("Expected only the large message to be rejected, got %q", codes)
+	}
+}
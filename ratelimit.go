@@ -0,0 +1,102 @@
+package milter
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+// RateLimiter decides whether a new connection from addr is handled, connections
+// it refuses are closed right after being accepted
+type RateLimiter interface {
+	Allow(addr net.Addr) bool
+}
+
+// TokenBucket is a RateLimiter allowing each source IP Burst connections at once
+// and Rate connections per second on average
+type TokenBucket struct {
+	Rate  float64
+	Burst int
+
+	mu        sync.Mutex
+	buckets   map[string]*bucket
+	lastPrune time.Time
+	now       func() time.Time
+}
+
+// bucket holds the tokens left for a source address
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// NewTokenBucket returns a TokenBucket for rate connections per second per source IP
+// with bursts of up to burst connections
+func NewTokenBucket(rate float64, burst int) *TokenBucket {
+	return &TokenBucket{Rate: rate, Burst: burst}
+}
+
+// Allow takes a token from the bucket of the IP addr, it reports false if there are
+// none left
+func (t *TokenBucket) Allow(addr net.Addr) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	now := time.Now()
+	if t.now != nil {
+		now = t.now()
+	}
+	if t.buckets == nil {
+		t.buckets = map[string]*bucket{}
+	}
+	t.prune(now)
+
+	key := sourceIP(addr)
+	b, ok := t.buckets[key]
+	if !ok {
+		b = &bucket{tokens: float64(t.Burst), last: now}
+		t.buckets[key] = b
+	}
+	b.tokens = t.refill(b, now)
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// refill returns the tokens of b at now, at most Burst
+func (t *TokenBucket) refill(b *bucket, now time.Time) float64 {
+	tokens := b.tokens + now.Sub(b.last).Seconds()*t.Rate
+	if tokens > float64(t.Burst) {
+		tokens = float64(t.Burst)
+	}
+	return tokens
+}
+
+// prune forgets full buckets once a minute so idle addresses do not pile up
+func (t *TokenBucket) prune(now time.Time) {
+	if now.Sub(t.lastPrune) < time.Minute {
+		return
+	}
+	t.lastPrune = now
+	for key, b := range t.buckets {
+		if t.refill(b, now) >= float64(t.Burst) {
+			delete(t.buckets, key)
+		}
+	}
+}
+
+// sourceIP returns the IP of addr without the port, or addr itself for other addresses
+func sourceIP(addr net.Addr) string {
+	if addr == nil {
+		return ""
+	}
+	if tcp, ok := addr.(*net.TCPAddr); ok {
+		return tcp.IP.String()
+	}
+	if host, _, err := net.SplitHostPort(addr.String()); err == nil {
+		return host
+	}
+	return addr.String()
+}
@@ -0,0 +1,38 @@
+package milter
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestTokenBucket(t *testing.T) {
+	now := time.Unix(1000, 0)
+	limiter := NewTokenBucket(1, 2)
+	limiter.now = func() time.Time { return now }
+	client := &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 1234}
+	other := &net.TCPAddr{IP: net.ParseIP("192.0.2.2"), Port: 1234}
+
+	for i, expected := range []bool{true, true, false} {
+		// the source port does not matter
+		client.Port++
+		if allowed := limiter.Allow(client); allowed != expected {
+			t.Errorf("Connection %d: got %v, expected %v", i, allowed, expected)
+		}
+	}
+	if !limiter.Allow(other) {
+		t.Error("Expected other addresses to have their own bucket")
+	}
+
+	now = now.Add(time.Second)
+	if !limiter.Allow(client) || limiter.Allow(client) {
+		t.Error("Expected one token to be refilled after a second")
+	}
+
+	// idle addresses are forgotten
+	now = now.Add(time.Hour)
+	limiter.Allow(other)
+	if _, ok := limiter.buckets["192.0.2.1"]; ok {
+		t.Error("Expected full bucket to be pruned")
+	}
+}
@@ -1,5 +1,10 @@
 package milter
 
+import (
+	"strconv"
+	"strings"
+)
+
 // Response represents a response structure returned by callback
 // handlers to indicate how the milter server should proceed
 type Response interface {
@@ -27,8 +32,55 @@ const (
 	RespDiscard  = SimpleResponse(discard)
 	RespReject   = SimpleResponse(reject)
 	RespTempFail = SimpleResponse(tempFail)
+
+	// RespSkip tells the MTA to send no further body chunks, it is only valid
+	// from BodyChunk and if Modifier.CanSkip is true
+	RespSkip = SimpleResponse(skip)
 )
 
+// closeResponse is sent like resp, then the session is closed
+type closeResponse struct {
+	resp Response
+}
+
+// Response returns the Message of the wrapped response
+func (r closeResponse) Response() *Message {
+	return r.resp.Response()
+}
+
+// Continue reports whether the wrapped response continues
+func (r closeResponse) Continue() bool {
+	return r.resp.Continue()
+}
+
+// CloseConnection returns a response sending resp and closing the connection to the
+// MTA afterwards, e.g. when the milter is shutting down. The MTA opens a new
+// connection for further messages
+func CloseConnection(resp Response) Response {
+	return closeResponse{resp}
+}
+
+// RespCloseConnection accepts the message and closes the connection to the MTA
+var RespCloseConnection = CloseConnection(RespAccept)
+
+// closing reports whether r asks for the connection to be closed
+func closing(r Response) bool {
+	_, ok := r.(closeResponse)
+	return ok
+}
+
+// rejected reports whether r refuses the command it was returned for
+func rejected(r Response) bool {
+	if r == nil {
+		return false
+	}
+	switch r.Response().Code {
+	case reject, tempFail, SMFIR_REPLYCODE:
+		return true
+	}
+	return false
+}
+
 // CustomResponse is a response instance used by callback handlers to indicate
 // how the milter should continue processing of current message
 type CustomResponse struct {
@@ -43,7 +95,7 @@ func (c *CustomResponse) Response() *Message {
 
 // Continue returns false if milter chain should be stopped, true otherwise
 func (c *CustomResponse) Continue() bool {
-	for _, q := range []byte{accept, discard, reject, tempFail} {
+	for _, q := range []byte{accept, discard, reject, tempFail, SMFIR_REPLYCODE} {
 		if c.code == q {
 			return false
 		}
@@ -62,3 +114,22 @@ func NewResponse(code byte, data []byte) *CustomResponse {
 func NewResponseStr(code byte, data string) *CustomResponse {
 	return NewResponse(code, []byte(data+null))
 }
+
+// NewReplyResponse generates a SMFIR_REPLYCODE response with a 4xx or 5xx SMTP code, an
+// optional enhanced status code like "5.7.1" and a reply text. Multi-line replies are
+// passed as they are, "%" is escaped as the MTA uses the text as format string
+func NewReplyResponse(code uint16, xcode, text string) (Response, error) {
+	if code < 400 || code > 599 {
+		return nil, ErrInvalidReplyCode
+	}
+	reply := strconv.Itoa(int(code))
+	if xcode != "" {
+		// the class of the enhanced code has to match the reply code
+		if !strings.HasPrefix(xcode, reply[:1]+".") {
+			return nil, ErrInvalidReplyCode
+		}
+		reply += " " + xcode
+	}
+	reply += " " + strings.Replace(text, "%", "%%", -1)
+	return NewResponseStr(SMFIR_REPLYCODE, reply), nil
+}
@@ -0,0 +1,62 @@
+package milter
+
+import (
+	"net/textproto"
+	"testing"
+)
+
+func TestNewReplyResponse(t *testing.T) {
+	tests := []struct {
+		code  uint16
+		xcode string
+		text  string
+		data  string
+		err   error
+	}{
+		{550, "5.7.1", "Blocked by policy", "550 5.7.1 Blocked by policy\x00", nil},
+		{451, "", "Try again later", "451 Try again later\x00", nil},
+		{550, "5.7.1", "100% spam", "550 5.7.1 100%% spam\x00", nil},
+		{550, "5.7.1", "first\r\n550-5.7.1 second", "550 5.7.1 first\r\n550-5.7.1 second\x00", nil},
+		{250, "", "OK", "", ErrInvalidReplyCode},
+		{600, "", "Too big", "", ErrInvalidReplyCode},
+		{550, "4.7.1", "Class mismatch", "", ErrInvalidReplyCode},
+	}
+	for _, test := range tests {
+		resp, err := NewReplyResponse(test.code, test.xcode, test.text)
+		if err != test.err {
+			t.Errorf("%d %s: got error %v, expected %v", test.code, test.xcode, err, test.err)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		msg := resp.Response()
+		if msg.Code != SMFIR_REPLYCODE || string(msg.Data) != test.data {
+			t.Errorf("%d %s: got %c %q, expected %q", test.code, test.xcode, msg.Code, msg.Data, test.data)
+		}
+		if resp.Continue() {
+			t.Errorf("%d %s: expected reply to stop processing", test.code, test.xcode)
+		}
+	}
+}
+
+func TestDiscardRejectResponses(t *testing.T) {
+	for _, resp := range []Response{RespDiscard, RespReject} {
+		if resp.Continue() {
+			t.Errorf("Expected %c to stop processing", resp.Response().Code)
+		}
+		milter := &hookMilter{
+			headers: func(h textproto.MIMEHeader, m *Modifier) (Response, error) { return resp, nil },
+			body:    func(m *Modifier) (Response, error) { return resp, nil },
+		}
+		session, sock, _ := newTestSession(milter, 0, 0)
+		sock.send('N', nil)
+		sock.send('E', nil)
+		session.HandleMilterCommands()
+
+		expected := string([]byte{resp.Response().Code, resp.Response().Code})
+		if codes := sock.codes(t); codes != expected {
+			t.Errorf("Expected replies %q, got %q", expected, codes)
+		}
+	}
+}
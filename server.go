@@ -2,10 +2,17 @@
 package milter
 
 import (
+	"context"
+	"crypto/tls"
 	"errors"
 	"fmt"
+	"io"
 	"net"
+	"net/textproto"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
 var defaultServer Server
@@ -14,6 +21,9 @@ var defaultServer Server
 // multiple options can be set using a bitmask
 type MilterInit func() (Milter, OptAction, OptProtocol)
 
+// MilterAddrInit is a MilterInit for the connection from the MTA at addr
+type MilterAddrInit func(addr net.Addr) (Milter, OptAction, OptProtocol)
+
 // RunServer provides a convenient way to start a milter server
 // Handlers provide way to handle errors from panics
 // With nil handlers panics not recovered
@@ -25,6 +35,45 @@ func RunServer(server net.Listener, logger Logger, init MilterInit, handlers ...
 	return defaultServer.RunServer()
 }
 
+// ServeConn runs a single milter session on conn, e.g. stdin and stdout for
+// testing with MTA tools, and returns when it ends. conn is closed.
+// Handlers get errors as with RunServer, with nil handlers panics are not
+// recovered
+func ServeConn(conn io.ReadWriteCloser, init MilterInit, logger Logger, handlers ...func(error)) {
+	ServeConnContext(context.Background(), conn, init, logger, handlers...)
+}
+
+// ServeConnContext is ServeConn closing conn when ctx is cancelled, this also ends
+// a reply delayed by Modifier.Delay
+func ServeConnContext(ctx context.Context, conn io.ReadWriteCloser, init MilterInit, logger Logger, handlers ...func(error)) {
+	defer handlePanic(handlers)
+	if ctx.Done() != nil {
+		done := make(chan struct{})
+		defer close(done)
+		go func() {
+			select {
+			case <-ctx.Done():
+				conn.Close()
+			case <-done:
+			}
+		}()
+	}
+	if logger == nil {
+		logger = NopLogger
+	}
+	milter, actions, protocol := initConn(conn, init)
+	session := milterSession{
+		actions:     actions,
+		protocol:    protocol,
+		sock:        conn,
+		milter:      milter,
+		logger:      logger,
+		errHandlers: handlers,
+		done:        ctx.Done(),
+	}
+	session.HandleMilterCommands()
+}
+
 // Close server listener and wait worked process
 func Close() (err error) {
 	return defaultServer.Close()
@@ -34,10 +83,113 @@ func Close() (err error) {
 // support panic handling via ErrHandler
 // couple of func(error) could be provided for handling error
 type Server struct {
+	// number of connections and messages handled, first for 64-bit alignment of
+	// atomic access
+	connections uint64
+	messages    uint64
+	// open connections, closed by Shutdown when it gives up waiting
+	mu    sync.Mutex
+	conns map[net.Conn]struct{}
+
 	Listener      net.Listener
 	MilterFactory MilterInit
 	ErrHandlers   []func(error)
 	Logger        Logger
+	// Listeners are served along with Listener, e.g. a unix socket for a local MTA
+	// and a TCP port for remote ones. Close closes all of them
+	Listeners []net.Listener
+	// MilterAddrFactory is used instead of MilterFactory if set, it gets the
+	// remote address of each connection
+	MilterAddrFactory MilterAddrInit
+	// OnNoActions is called when the MTA offers no actions but the milter
+	// wants some, returning an error closes the connection
+	OnNoActions func(wanted OptAction) error
+	// RequiredActions and RequiredProtocol must be offered by the MTA,
+	// otherwise the connection is closed during negotiation
+	RequiredActions  OptAction
+	RequiredProtocol OptProtocol
+	// OnHealthCheck is called for connections that negotiate and quit
+	// right away, the milter is not involved in such connections
+	OnHealthCheck func()
+	// PreserveAddressCase passes envelope addresses to MailFrom and RcptTo as sent
+	// by the MTA instead of lower casing them, angle brackets are always removed
+	PreserveAddressCase bool
+	// PanicResponse is sent to the MTA when a milter callback panics,
+	// defaults to RespTempFail
+	PanicResponse Response
+	// ConnLogSampleRate logs the opening and closing of one in every
+	// ConnLogSampleRate connections, zero disables connection logging
+	ConnLogSampleRate int
+	// ErrorResponse maps an error returned by a milter callback to the response
+	// sent to the MTA, without it or when it returns nil the session is closed.
+	// A ProtocolError always closes the session
+	ErrorResponse func(stage Stage, err error) Response
+	// OnConnectionClose is called at the end of each connection with its
+	// duration and the number of messages it carried
+	OnConnectionClose func(duration time.Duration, messages int)
+	// NewSessionID and NewMessageID generate the IDs returned by
+	// Modifier.SessionID and Modifier.MessageID, without them IDs are empty.
+	// They can be deterministic in tests or derive IDs from trace IDs, a
+	// single func can be used for both. A session started on the connection after
+	// SMFIC_QUIT_NC gets a new ID
+	NewSessionID func() string
+	NewMessageID func() string
+	// DefaultDisposition is sent at the end of a message when Body
+	// returns RespContinue or no response, defaults to RespAccept
+	DefaultDisposition Response
+	// MaxDataSize limits the size of packets read from the MTA, defaults to
+	// 1MB when OptMDS1M is negotiated and 256KB otherwise
+	MaxDataSize uint32
+	// TLSConfig makes the server expect TLS on accepted connections, handshake
+	// errors are passed to ErrHandlers
+	TLSConfig *tls.Config
+	// MaxConnections limits the number of connections handled at the same time,
+	// ConnectionLimit selects what happens to further connections. Zero means
+	// no limit
+	MaxConnections  int
+	ConnectionLimit LimitMode
+	// Metrics is told about connections and commands if set
+	Metrics Metrics
+	// BufferBody collects the body of each message for Modifier.BodyReader,
+	// messages with bodies larger than MaxBodySize (defaults to 10240000
+	// bytes) are tempfailed
+	BufferBody  bool
+	MaxBodySize int64
+	// ReadTimeout and WriteTimeout limit the time waiting for each packet to be
+	// read from or written to the MTA, timeouts close the connection and are
+	// passed to ErrHandlers like a ProtocolError. Zero means no timeout
+	ReadTimeout  time.Duration
+	WriteTimeout time.Duration
+	// IdleTimeout closes connections which wait longer for the next message than
+	// that, ReadTimeout applies within messages. Zero means no timeout
+	IdleTimeout time.Duration
+	// RecoverPerCommand recovers panics of milter callbacks for each command, the
+	// command gets PanicResponse and the session goes on. The panic is passed to
+	// ErrHandlers. Otherwise the session ends
+	RecoverPerCommand bool
+	// AutoProgressInterval makes sessions tell the MTA to keep waiting every
+	// AutoProgressInterval while a milter callback runs, like Modifier.Progress
+	AutoProgressInterval time.Duration
+	// DeliverEmptyChunks passes zero-length body chunks some MTAs send on to
+	// BodyChunk, by default they are answered with RespContinue right away
+	DeliverEmptyChunks bool
+	// UnfoldHeaders passes folded header values to Header as a single line,
+	// Modifier.RawHeaderValue returns the value as sent
+	UnfoldHeaders bool
+	// RateLimiter is asked about every accepted connection, the ones it does
+	// not allow are closed without starting a session
+	RateLimiter RateLimiter
+	// OnConnect is called with each accepted connection before the milter is
+	// created, if it returns an error the connection is closed without starting
+	// a session, e.g. to refuse unknown sources cheaply. Shutdown closes conn while
+	// the hook runs, it should return then
+	OnConnect func(conn net.Conn) error
+	// MessageTimeout limits the total time spent in the callbacks of a message,
+	// starting with MAIL FROM. Once exceeded the current and all later commands of
+	// the message get RespTempFail. At RCPT that only refuses the recipient, the
+	// message fails at DATA, or at the end of the message if the MTA waits for no
+	// earlier reply. Zero means no limit
+	MessageTimeout time.Duration
 	sync.WaitGroup
 }
 
@@ -45,72 +197,486 @@ type Server struct {
 // Stop accepting new connections
 // And wait until processing connections ends
 func (s *Server) Close() (err error) {
+	err = s.closeListeners()
+	s.Wait()
+	return err
+}
+
+// listeners returns Listener and Listeners
+func (s *Server) listeners() []net.Listener {
+	var listeners []net.Listener
 	if s.Listener != nil {
-		err = s.Listener.Close()
+		listeners = append(listeners, s.Listener)
+	}
+	for _, l := range s.Listeners {
+		if l != nil {
+			listeners = append(listeners, l)
+		}
+	}
+	return listeners
+}
+
+// closeListeners closes all listeners, returning the first error
+func (s *Server) closeListeners() error {
+	var err error
+	for _, l := range s.listeners() {
+		if e := l.Close(); e != nil && err == nil {
+			err = e
+		}
 	}
-	s.Wait()
 	return err
 }
 
+// Shutdown stops accepting new connections and waits until processing connections
+// ends. If ctx is done first the remaining connections are closed and ctx.Err()
+// is returned
+func (s *Server) Shutdown(ctx context.Context) error {
+	err := s.closeListeners()
+	done := make(chan struct{})
+	go func() {
+		s.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return err
+	case <-ctx.Done():
+		s.mu.Lock()
+		for conn := range s.conns {
+			conn.Close()
+		}
+		s.mu.Unlock()
+		return ctx.Err()
+	}
+}
+
+// ActiveConnections returns the number of connections being handled, including the
+// ones tempfailed above MaxConnections
+func (s *Server) ActiveConnections() int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return int64(len(s.conns))
+}
+
+// TotalConnections returns the number of connections handled since the server started,
+// connections tempfailed above MaxConnections are not included
+func (s *Server) TotalConnections() uint64 {
+	return atomic.LoadUint64(&s.connections)
+}
+
+// TotalMessages returns the number of messages started with MAIL FROM on all connections
+func (s *Server) TotalMessages() uint64 {
+	return atomic.LoadUint64(&s.messages)
+}
+
+// track adds conn to the open connections, remove deletes it again
+func (s *Server) track(conn net.Conn) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.conns == nil {
+		s.conns = make(map[net.Conn]struct{})
+	}
+	s.conns[conn] = struct{}{}
+}
+
+func (s *Server) remove(conn net.Conn) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.conns, conn)
+}
+
 // RunServer starts milter server via provided listener
 func (s *Server) RunServer() error {
-	if s.Listener == nil {
+	if len(s.listeners()) == 0 {
+		return errors.New("no listen addr specified")
+	}
+	return s.serve(context.Background())
+}
+
+// RunServerContext starts milter server via provided listener until ctx is
+// cancelled, the listener is then closed and open connections are aborted.
+// It returns once all connections are handled
+func (s *Server) RunServerContext(ctx context.Context) error {
+	if len(s.listeners()) == 0 {
 		return errors.New("no listen addr specified")
 	}
 
+	// stop accepting when the context is cancelled
+	stop := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			s.closeListeners()
+		case <-stop:
+		}
+	}()
+	err := s.serve(ctx)
+	close(stop)
+	s.Wait()
+
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return err
+}
+
+// serve accepts connections on all listeners, once one of them fails the others are
+// closed. It returns the first error
+func (s *Server) serve(ctx context.Context) error {
+	// a slot is taken for each connection handled, on all listeners
+	var slots chan struct{}
+	if s.MaxConnections > 0 {
+		slots = make(chan struct{}, s.MaxConnections)
+	}
+
+	listeners := s.listeners()
+	type result struct {
+		listener net.Listener
+		err      error
+	}
+	done := make(chan result, len(listeners))
+	for _, l := range listeners {
+		go func(l net.Listener) {
+			done <- result{l, s.accept(ctx, l, slots)}
+		}(l)
+	}
+	var err error
+	for i := range listeners {
+		r := <-done
+		if i == 0 {
+			err = r.err
+			for _, l := range listeners {
+				if l != r.listener {
+					l.Close()
+				}
+			}
+		}
+	}
+	return err
+}
+
+// Bounds of the delay before accepting again after a temporary error
+const (
+	minAcceptDelay = 5 * time.Millisecond
+	maxAcceptDelay = time.Second
+)
+
+// accept accepts connections from l handling each of them in a goroutine
+// Temporary errors like running out of file descriptors are retried after a delay
+// growing up to maxAcceptDelay
+func (s *Server) accept(ctx context.Context, l net.Listener, slots chan struct{}) error {
+	var delay time.Duration
 	for {
 		// accept connection from client
-		conn, err := s.Listener.Accept()
-		if conn == nil {
-			return nil
-		}
-		if err != nil {
+		conn, err := l.Accept()
+		if conn == nil || err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				if delay == 0 {
+					delay = minAcceptDelay
+				} else if delay *= 2; delay > maxAcceptDelay {
+					delay = maxAcceptDelay
+				}
+				logWarn(s.logger(), "Error accepting connection: %v, retrying in %v", err, delay)
+				select {
+				case <-time.After(delay):
+				case <-ctx.Done():
+					return nil
+				}
+				continue
+			}
+			// closing the listener ends serving
+			if err == nil || closedError(err) || ctx.Err() != nil {
+				return nil
+			}
 			return err
 		}
+		delay = 0
+		if s.RateLimiter != nil && !s.RateLimiter.Allow(conn.RemoteAddr()) {
+			conn.Close()
+			continue
+		}
 
 		s.Add(1)
+		handle, taken := s.handleCon, false
+		switch {
+		case slots == nil:
+		case s.ConnectionLimit == LimitBlock:
+			// wait for a connection to end before handling this one, no other is
+			// accepted meanwhile. Shutdown can close it while it waits
+			s.track(conn)
+			select {
+			case slots <- struct{}{}:
+				taken = true
+			case <-ctx.Done():
+				s.remove(conn)
+				conn.Close()
+				s.Done()
+				return nil
+			}
+		default:
+			select {
+			case slots <- struct{}{}:
+				taken = true
+			default:
+				handle = s.rejectCon
+			}
+		}
+
 		go func() {
-			defer handlePanic(s.ErrHandlers)
+			// report panics before Close stops waiting
 			defer s.Done()
-			s.handleCon(conn)
+			defer handlePanic(s.ErrHandlers)
+			if taken {
+				defer func() { <-slots }()
+			}
+			handle(ctx, conn)
 		}()
 	}
 }
 
-// Handle incoming connections
-func (s *Server) handleCon(conn net.Conn) {
+// closedError reports whether err is returned by a closed listener, net.ErrClosed is
+// not available before Go 1.16
+func closedError(err error) bool {
+	return strings.Contains(err.Error(), "use of closed network connection")
+}
+
+// logger returns Logger, or NopLogger if it is not set
+func (s *Server) logger() Logger {
+	if s.Logger == nil {
+		return NopLogger
+	}
+	return s.Logger
+}
+
+// watch tracks conn for Shutdown and closes it when ctx is cancelled, until the
+// returned func is called
+func (s *Server) watch(ctx context.Context, conn net.Conn) func() {
+	s.track(conn)
+	if ctx.Done() == nil {
+		return func() { s.remove(conn) }
+	}
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-done:
+		}
+	}()
+	return func() {
+		close(done)
+		s.remove(conn)
+	}
+}
+
+// rejectCon tempfails a connection above MaxConnections, the milter is not involved
+func (s *Server) rejectCon(ctx context.Context, conn net.Conn) {
+	defer s.watch(ctx, conn)()
+	logger := s.logger()
+	logWarn(logger, "Too many connections, tempfailing connection from %v", conn.RemoteAddr())
+	session := milterSession{
+		sock:         conn,
+		milter:       tempFailMilter{},
+		logger:       logger,
+		readTimeout:  s.ReadTimeout,
+		writeTimeout: s.WriteTimeout,
+	}
+	session.HandleMilterCommands()
+}
+
+// LimitMode selects how connections above Server.MaxConnections are handled
+type LimitMode int
+
+// Define connection limit modes
+const (
+	LimitBlock  LimitMode = iota // stop accepting until a connection ends
+	LimitReject                  // accept and tempfail the connection
+)
+
+// Handle incoming connections, the connection is closed when ctx is cancelled
+func (s *Server) handleCon(ctx context.Context, conn net.Conn) {
+	defer s.watch(ctx, conn)()
+	// Shutdown and ctx can close the connection while the hook runs
+	if s.OnConnect != nil {
+		if err := s.OnConnect(conn); err != nil {
+			logInfo(s.logger(), "Refusing connection from %v: %v", conn.RemoteAddr(), err)
+			conn.Close()
+			return
+		}
+	}
+
+	// log a sample of connections, errors are always logged by the session
+	n := atomic.AddUint64(&s.connections, 1)
+	if s.ConnLogSampleRate > 0 && (n-1)%uint64(s.ConnLogSampleRate) == 0 {
+		logInfo(s.logger(), "Connection %d from %v opened", n, conn.RemoteAddr())
+		defer logInfo(s.logger(), "Connection %d from %v closed", n, conn.RemoteAddr())
+	}
+
+	if s.TLSConfig != nil {
+		tlsConn, err := s.handshake(conn)
+		if err != nil {
+			conn.Close()
+			for _, f := range s.ErrHandlers {
+				f(err)
+			}
+			return
+		}
+		conn = tlsConn
+	}
+
+	start := time.Now()
+	if s.Metrics != nil {
+		s.Metrics.ConnectionOpened()
+		defer func() {
+			s.Metrics.ConnectionClosed(time.Since(start))
+		}()
+	}
+
 	// create milter object
-	milter, actions, protocol := s.MilterFactory()
+	milter, actions, protocol := s.newMilter(conn)
 	session := milterSession{
 		actions:  actions,
 		protocol: protocol,
 		sock:     conn,
 		milter:   milter,
-		logger:   s.Logger,
+		logger:   s.logger(),
+
+		onNoActions:      s.OnNoActions,
+		onHealthCheck:    s.OnHealthCheck,
+		requiredActions:  s.RequiredActions,
+		requiredProtocol: s.RequiredProtocol,
+
+		panicResponse:     s.PanicResponse,
+		errorResponse:     s.ErrorResponse,
+		recoverPerCommand: s.RecoverPerCommand,
+		errHandlers:       s.ErrHandlers,
+		disposition:       s.DefaultDisposition,
+
+		readTimeout:          s.ReadTimeout,
+		writeTimeout:         s.WriteTimeout,
+		idleTimeout:          s.IdleTimeout,
+		messageTimeout:       s.MessageTimeout,
+		autoProgressInterval: s.AutoProgressInterval,
+
+		maxDataSize:         s.MaxDataSize,
+		bufferBody:          s.BufferBody,
+		maxBodySize:         s.MaxBodySize,
+		deliverEmptyChunks:  s.DeliverEmptyChunks,
+		unfoldHeaders:       s.UnfoldHeaders,
+		preserveAddressCase: s.PreserveAddressCase,
+
+		newSessionID:  s.NewSessionID,
+		newMessageID:  s.NewMessageID,
+		metrics:       s.Metrics,
+		totalMessages: &s.messages,
+		done:          ctx.Done(),
+	}
+	if session.newSessionID != nil {
+		session.sessionID = session.newSessionID()
+	}
+	if s.OnConnectionClose != nil {
+		defer func() {
+			s.OnConnectionClose(time.Since(start), session.earlierMessages+session.messages)
+		}()
 	}
 	// handle connection commands
 	session.HandleMilterCommands()
 }
 
+// handshake runs the TLS handshake of conn, limited by ReadTimeout
+func (s *Server) handshake(conn net.Conn) (net.Conn, error) {
+	tlsConn := tls.Server(conn, s.TLSConfig)
+	if s.ReadTimeout > 0 {
+		tlsConn.SetDeadline(time.Now().Add(s.ReadTimeout))
+		defer tlsConn.SetDeadline(time.Time{})
+	}
+	if err := tlsConn.Handshake(); err != nil {
+		return nil, err
+	}
+	return tlsConn, nil
+}
+
+// newMilter calls MilterAddrFactory or MilterFactory, the connection is closed if it panics
+// so that the MTA is not left waiting
+func (s *Server) newMilter(conn net.Conn) (Milter, OptAction, OptProtocol) {
+	defer func() {
+		if r := recover(); r != nil {
+			conn.Close()
+			panic(r)
+		}
+	}()
+	if s.MilterAddrFactory != nil {
+		return s.MilterAddrFactory(conn.RemoteAddr())
+	}
+	return s.MilterFactory()
+}
+
+// initConn calls init for a connection served by ServeConnContext, conn is closed if
+// it panics so that the MTA is not left waiting
+func initConn(conn io.Closer, init MilterInit) (Milter, OptAction, OptProtocol) {
+	defer func() {
+		if r := recover(); r != nil {
+			conn.Close()
+			panic(r)
+		}
+	}()
+	return init()
+}
+
 // Recover panic from session and call handle with occurred error
 // If no any handle provided panics will not recovered
 func handlePanic(handlers []func(error)) {
-	var err error
-
 	if handlers == nil {
 		return
 	}
 
 	r := recover()
-	switch r.(type) {
-	case nil:
+	if r == nil {
 		return
-	case error:
-		err = r.(error)
-	default:
-		err = errors.New(fmt.Sprint(r))
 	}
+	err := panicError(r)
 	for _, f := range handlers {
 		f(err)
 	}
 }
+
+// panicError returns the recovered value r as an error
+func panicError(r interface{}) error {
+	if err, ok := r.(error); ok {
+		return err
+	}
+	return errors.New(fmt.Sprint(r))
+}
+
+// tempFailMilter tempfails every stage of a session
+type tempFailMilter struct{}
+
+func (tempFailMilter) NewSession(Logger) {}
+func (tempFailMilter) NewMessage()       {}
+func (tempFailMilter) Reset()            {}
+func (tempFailMilter) EndSession()       {}
+
+func (tempFailMilter) Connect(string, string, uint16, net.IP, *Modifier) (Response, error) {
+	return RespTempFail, nil
+}
+
+func (tempFailMilter) Helo(string, *Modifier) (Response, error) { return RespTempFail, nil }
+
+func (tempFailMilter) MailFrom(string, []string, *Modifier) (Response, error) {
+	return RespTempFail, nil
+}
+
+func (tempFailMilter) RcptTo(string, []string, *Modifier) (Response, error) {
+	return RespTempFail, nil
+}
+
+func (tempFailMilter) Header(string, string, *Modifier) (Response, error) {
+	return RespTempFail, nil
+}
+
+func (tempFailMilter) Headers(textproto.MIMEHeader, *Modifier) (Response, error) {
+	return RespTempFail, nil
+}
+
+func (tempFailMilter) BodyChunk([]byte, *Modifier) (Response, error) { return RespTempFail, nil }
+func (tempFailMilter) Body(*Modifier) (Response, error)              { return RespTempFail, nil }
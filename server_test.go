@@ -2,13 +2,30 @@ package milter
 
 import (
 	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"log"
+	"math/big"
 	"net"
 	"net/textproto"
 	"os"
+	"path/filepath"
+	"reflect"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"testing"
+	"time"
 
 	"github.com/mschneider82/milterclient"
 )
@@ -19,6 +36,8 @@ type TestMilter struct {
 	message   *bytes.Buffer
 }
 
+var _ Milter = (*TestMilter)(nil)
+
 // https://github.com/cwedgwood/milter/blob/master/interface.go
 func (e *TestMilter) NewSession(Logger)                        {}
 func (e *TestMilter) EndSession()                              {}
@@ -30,11 +49,11 @@ func (e *TestMilter) Connect(name, value string, port uint16, ip net.IP, m *Modi
 	return RespContinue, nil
 }
 
-func (e *TestMilter) MailFrom(name string, m *Modifier) (Response, error) {
+func (e *TestMilter) MailFrom(name string, args []string, m *Modifier) (Response, error) {
 	return RespContinue, nil
 }
 
-func (e *TestMilter) RcptTo(name string, m *Modifier) (Response, error) {
+func (e *TestMilter) RcptTo(name string, args []string, m *Modifier) (Response, error) {
 	return RespContinue, nil
 }
 
@@ -157,3 +176,1111 @@ func TestMilterClient(t *testing.T) {
 	}
 	socket.Close()
 }
+
+// startTestServer runs server on a local TCP port and returns its address
+func startTestServer(t *testing.T, server *Server) string {
+	t.Helper()
+	socket, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server.Listener = socket
+	go server.RunServer()
+	return socket.Addr().String()
+}
+
+// exchange sends a command to the milter and reads the reply
+func exchange(client *milterSession, code byte, data []byte) (*Message, error) {
+	if err := client.WritePacket(&Message{code, data}); err != nil {
+		return nil, err
+	}
+	return client.ReadPacket()
+}
+
+func TestPanicIsolation(t *testing.T) {
+	var mu sync.Mutex
+	var reported []error
+	server := &Server{
+		MilterFactory: func() (Milter, OptAction, OptProtocol) {
+			return &hookMilter{
+				helo: func(name string, m *Modifier) (Response, error) {
+					if name == "panic" {
+						panic("helo handler failed")
+					}
+					return RespContinue, nil
+				},
+			}, 0, 0
+		},
+		ErrHandlers: []func(error){func(err error) {
+			mu.Lock()
+			defer mu.Unlock()
+			reported = append(reported, err)
+		}},
+		Logger: &testLogger{},
+	}
+	addr := startTestServer(t, server)
+
+	conns := make([]*milterSession, 2)
+	for i := range conns {
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		conns[i] = &milterSession{sock: conn}
+		if _, err := exchange(conns[i], 'O', optneg(6, OptAllActions, 0)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// the first connection panics while the second one is still open
+	if msg, err := exchange(conns[0], 'H', cstrings("panic")); err != nil || msg.Code != 't' {
+		t.Errorf("Expected tempfail from panicking connection, got %v %v", msg, err)
+	}
+	if _, err := conns[0].ReadPacket(); err != io.EOF {
+		t.Errorf("Expected panicking connection to be closed, got %v", err)
+	}
+	for _, code := range []byte{'H', 'M'} {
+		if msg, err := exchange(conns[1], code, cstrings("mx.example.com")); err != nil || msg.Code != 'c' {
+			t.Errorf("Expected continue from concurrent connection, got %v %v", msg, err)
+		}
+	}
+	conns[1].WritePacket(&Message{'Q', nil})
+	conns[1].sock.Close()
+	server.Close()
+
+	if len(reported) != 1 || reported[0].Error() != "helo handler failed" {
+		t.Errorf("Expected panic to be reported once, got %v", reported)
+	}
+	if !server.Logger.(*testLogger).contains("goroutine") {
+		t.Error("Expected panic to be logged with stack")
+	}
+}
+
+func TestValidateMilter(t *testing.T) {
+	// TestMilter is a bare Milter
+	if c, err := ValidateMilter(&TestMilter{}); err != nil || c != 0 {
+		t.Errorf("Expected TestMilter to be valid without optional interfaces, got %v %v", c, err)
+	}
+	tests := []struct {
+		milter Milter
+		caps   Capabilities
+	}{
+		{&hookMilter{}, 0},
+		{&unknownMilter{}, CapUnknown},
+		{&dataMilter{}, CapData},
+		{&abortMilter{}, CapAbort},
+		{&negotiateMilter{}, CapNegotiate},
+	}
+	for _, test := range tests {
+		if c, err := ValidateMilter(test.milter); err != nil || c != test.caps {
+			t.Errorf("%T: expected %v, got %v %v", test.milter, test.caps, c, err)
+		}
+	}
+	if _, err := ValidateMilter(nil); err != ErrNilMilter {
+		t.Errorf("Expected ErrNilMilter for nil interface, got %v", err)
+	}
+	if _, err := ValidateMilter((*TestMilter)(nil)); err != ErrNilMilter {
+		t.Errorf("Expected ErrNilMilter for nil pointer, got %v", err)
+	}
+}
+
+func TestCapabilitiesString(t *testing.T) {
+	tests := map[Capabilities]string{
+		0:                     "",
+		CapData:               "DataMilter",
+		CapUnknown | CapAbort: "UnknownMilter|AbortMilter",
+	}
+	for c, expected := range tests {
+		if s := c.String(); s != expected {
+			t.Errorf("Expected %q, got %q", expected, s)
+		}
+	}
+}
+
+func TestFactoryPanic(t *testing.T) {
+	reported := make(chan error, 1)
+	server := &Server{
+		MilterFactory: func() (Milter, OptAction, OptProtocol) {
+			panic("bad configuration")
+		},
+		ErrHandlers: []func(error){func(err error) { reported <- err }},
+	}
+	addr := startTestServer(t, server)
+	defer server.Close()
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	client := &milterSession{sock: conn}
+	// depending on timing the connection is reset rather than closed
+	if msg, err := exchange(client, 'O', optneg(6, OptAllActions, 0)); err == nil {
+		t.Errorf("Expected connection to be closed, got %v", msg)
+	}
+	if err := <-reported; err.Error() != "bad configuration" {
+		t.Errorf("Expected factory panic to be reported, got %v", err)
+	}
+}
+
+func TestConnLogSampleRate(t *testing.T) {
+	logger := &testLogger{}
+	server := &Server{
+		MilterFactory: func() (Milter, OptAction, OptProtocol) {
+			return &hookMilter{}, 0, 0
+		},
+		Logger:            logger,
+		ConnLogSampleRate: 3,
+	}
+	for i := 0; i < 9; i++ {
+		conn, client := net.Pipe()
+		client.Close()
+		server.handleCon(context.Background(), conn)
+	}
+
+	opened, closed := 0, 0
+	for _, line := range logger.lines {
+		if strings.HasSuffix(line, "opened") {
+			opened++
+		}
+		if strings.HasSuffix(line, "closed") {
+			closed++
+		}
+	}
+	if opened != 3 || closed != 3 {
+		t.Errorf("Expected 3 of 9 connections to be logged, got %q", logger.lines)
+	}
+}
+
+func TestOnConnectionClose(t *testing.T) {
+	var duration time.Duration
+	messages := -1
+	server := &Server{
+		MilterFactory: func() (Milter, OptAction, OptProtocol) {
+			return &hookMilter{
+				body: func(m *Modifier) (Response, error) {
+					time.Sleep(10 * time.Millisecond)
+					return RespAccept, nil
+				},
+			}, 0, 0
+		},
+		OnConnectionClose: func(d time.Duration, n int) {
+			duration, messages = d, n
+		},
+	}
+	conn, clientConn := net.Pipe()
+	go func() {
+		defer clientConn.Close()
+		client := &milterSession{sock: clientConn}
+		exchange(client, 'O', optneg(6, OptAllActions, 0))
+		for i := 0; i < 2; i++ {
+			exchange(client, 'M', cstrings("<from@example.com>"))
+			exchange(client, 'R', cstrings("<to@example.com>"))
+			exchange(client, 'E', nil)
+		}
+		client.WritePacket(&Message{'Q', nil})
+	}()
+	server.handleCon(context.Background(), conn)
+
+	if messages != 2 {
+		t.Errorf("Expected 2 messages, got %d", messages)
+	}
+	if duration < 20*time.Millisecond || duration > time.Minute {
+		t.Errorf("Got unexpected connection duration %v", duration)
+	}
+}
+
+func TestIDGenerators(t *testing.T) {
+	var ids []string
+	record := func(m *Modifier) (Response, error) {
+		ids = append(ids, m.SessionID()+"/"+m.MessageID())
+		return RespContinue, nil
+	}
+	sessions, messages := 0, 0
+	server := &Server{
+		MilterFactory: func() (Milter, OptAction, OptProtocol) {
+			return &hookMilter{
+				helo:     func(name string, m *Modifier) (Response, error) { return record(m) },
+				mailFrom: func(from string, args []string, m *Modifier) (Response, error) { return record(m) },
+				body:     record,
+			}, 0, 0
+		},
+		Logger: &testLogger{},
+		NewSessionID: func() string {
+			sessions++
+			return fmt.Sprintf("host1-s%d", sessions)
+		},
+		NewMessageID: func() string {
+			messages++
+			return fmt.Sprintf("m%d", messages)
+		},
+	}
+	conn, clientConn := net.Pipe()
+	go func() {
+		defer clientConn.Close()
+		client := &milterSession{sock: clientConn}
+		exchange(client, 'H', cstrings("client.example.org"))
+		for i := 0; i < 2; i++ {
+			exchange(client, 'M', cstrings("<from@example.com>"))
+			exchange(client, 'E', nil)
+		}
+	}()
+	server.handleCon(context.Background(), conn)
+
+	expected := []string{"host1-s1/", "host1-s1/m1", "host1-s1/m1", "host1-s1/m2", "host1-s1/m2"}
+	if !reflect.DeepEqual(ids, expected) {
+		t.Errorf("Got IDs %q, expected %q", ids, expected)
+	}
+}
+
+func TestRunServerContext(t *testing.T) {
+	socket, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &Server{
+		Listener: socket,
+		MilterFactory: func() (Milter, OptAction, OptProtocol) {
+			return &hookMilter{}, 0, 0
+		},
+		Logger: &testLogger{},
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	result := make(chan error)
+	go func() { result <- server.RunServerContext(ctx) }()
+
+	conn, err := net.Dial("tcp", socket.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	client := &milterSession{sock: conn}
+	if _, err := exchange(client, 'O', optneg(6, OptAllActions, 0)); err != nil {
+		t.Fatal(err)
+	}
+
+	// the open connection is stuck waiting for the next command
+	cancel()
+	select {
+	case err := <-result:
+		if err != context.Canceled {
+			t.Errorf("Expected context.Canceled, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("RunServerContext did not return after cancel")
+	}
+	if _, err := client.ReadPacket(); err == nil {
+		t.Error("Expected connection to be closed")
+	}
+	if _, err := net.Dial("tcp", socket.Addr().String()); err == nil {
+		t.Error("Expected listener to be closed")
+	}
+}
+
+func TestReadTimeout(t *testing.T) {
+	reported := make(chan error, 1)
+	server := &Server{
+		MilterFactory: func() (Milter, OptAction, OptProtocol) {
+			return &hookMilter{}, 0, 0
+		},
+		ErrHandlers: []func(error){func(err error) { reported <- err }},
+		Logger:      &testLogger{},
+		ReadTimeout: 50 * time.Millisecond,
+	}
+	addr := startTestServer(t, server)
+	defer server.Close()
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	client := &milterSession{sock: conn}
+	if _, err := exchange(client, 'O', optneg(6, OptAllActions, 0)); err != nil {
+		t.Fatal(err)
+	}
+
+	// stall after negotiating
+	select {
+	case err := <-reported:
+		if err, ok := err.(net.Error); !ok || !err.Timeout() {
+			t.Errorf("Expected timeout error, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Stalled connection was not timed out")
+	}
+	if _, err := client.ReadPacket(); err != io.EOF {
+		t.Errorf("Expected connection to be closed, got %v", err)
+	}
+}
+
+func TestShutdown(t *testing.T) {
+	server := &Server{
+		MilterFactory: func() (Milter, OptAction, OptProtocol) {
+			return &hookMilter{}, 0, 0
+		},
+		Logger: &testLogger{},
+	}
+	addr := startTestServer(t, server)
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	client := &milterSession{sock: conn}
+	if _, err := exchange(client, 'O', optneg(6, OptAllActions, 0)); err != nil {
+		t.Fatal(err)
+	}
+
+	// the connection finishing in time is waited for
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		client.WritePacket(&Message{'Q', nil})
+	}()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		t.Errorf("Expected clean shutdown, got %v", err)
+	}
+}
+
+func TestShutdownTimeout(t *testing.T) {
+	server := &Server{
+		MilterFactory: func() (Milter, OptAction, OptProtocol) {
+			return &hookMilter{}, 0, 0
+		},
+		Logger: &testLogger{},
+	}
+	addr := startTestServer(t, server)
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	client := &milterSession{sock: conn}
+	if _, err := exchange(client, 'O', optneg(6, OptAllActions, 0)); err != nil {
+		t.Fatal(err)
+	}
+
+	// the stuck connection is closed once the deadline passes
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != context.DeadlineExceeded {
+		t.Errorf("Expected context.DeadlineExceeded, got %v", err)
+	}
+	if _, err := client.ReadPacket(); err == nil {
+		t.Error("Expected connection to be closed")
+	}
+	server.Wait()
+}
+
+// testMetrics records the metrics events of a server
+type testMetrics struct {
+	opened, closed int
+	commands       []byte
+	errors         int
+}
+
+func (m *testMetrics) ConnectionOpened()                { m.opened++ }
+func (m *testMetrics) ConnectionClosed(d time.Duration) { m.closed++ }
+
+func (m *testMetrics) CommandProcessed(code byte, d time.Duration, err error) {
+	m.commands = append(m.commands, code)
+	if err != nil {
+		m.errors++
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	metrics := &testMetrics{}
+	server := &Server{
+		MilterFactory: func() (Milter, OptAction, OptProtocol) {
+			return &hookMilter{}, 0, 0
+		},
+		Logger:  &testLogger{},
+		Metrics: metrics,
+	}
+	conn, clientConn := net.Pipe()
+	go func() {
+		defer clientConn.Close()
+		client := &milterSession{sock: clientConn}
+		exchange(client, 'O', optneg(6, OptAllActions, 0))
+		exchange(client, 'M', cstrings("<from@example.com>"))
+		exchange(client, 'E', nil)
+		client.WritePacket(&Message{'Q', nil})
+	}()
+	server.handleCon(context.Background(), conn)
+
+	if metrics.opened != 1 || metrics.closed != 1 {
+		t.Errorf("Expected one connection, got %d opened and %d closed", metrics.opened, metrics.closed)
+	}
+	if string(metrics.commands) != "OMEQ" {
+		t.Errorf("Got commands %q", metrics.commands)
+	}
+	if metrics.errors != 0 {
+		t.Errorf("Expected quitting not to count as error, got %d errors", metrics.errors)
+	}
+}
+
+// testTLSConfig returns a server configuration with a self-signed certificate
+func testTLSConfig(t *testing.T) *tls.Config {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "milter.example.com"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &tls.Config{Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}}}
+}
+
+func TestTLS(t *testing.T) {
+	reported := make(chan error, 1)
+	server := &Server{
+		MilterFactory: func() (Milter, OptAction, OptProtocol) {
+			return &hookMilter{}, 0, 0
+		},
+		ErrHandlers: []func(error){func(err error) { reported <- err }},
+		Logger:      &testLogger{},
+		TLSConfig:   testTLSConfig(t),
+		ReadTimeout: 5 * time.Second,
+	}
+	addr := startTestServer(t, server)
+	defer server.Close()
+
+	conn, err := tls.Dial("tcp", addr, &tls.Config{InsecureSkipVerify: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := &milterSession{sock: conn}
+	if msg, err := exchange(client, 'O', optneg(6, OptAllActions, 0)); err != nil || msg.Code != 'O' {
+		t.Errorf("Expected negotiation over TLS, got %v %v", msg, err)
+	}
+	if msg, err := exchange(client, 'H', cstrings("client.example.org")); err != nil || msg.Code != 'c' {
+		t.Errorf("Expected continue over TLS, got %v %v", msg, err)
+	}
+	conn.Close()
+
+	// plain text clients fail the handshake
+	plain, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer plain.Close()
+	(&milterSession{sock: plain}).WritePacket(&Message{'O', optneg(6, OptAllActions, 0)})
+	select {
+	case err := <-reported:
+		if err == nil {
+			t.Error("Expected handshake error")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Handshake failure was not reported")
+	}
+}
+
+func TestMaxConnections(t *testing.T) {
+	for _, mode := range []LimitMode{LimitReject, LimitBlock} {
+		server := &Server{
+			MilterFactory: func() (Milter, OptAction, OptProtocol) {
+				return &hookMilter{}, 0, 0
+			},
+			Logger:          &testLogger{},
+			MaxConnections:  1,
+			ConnectionLimit: mode,
+		}
+		addr := startTestServer(t, server)
+
+		dial := func() (net.Conn, *milterSession) {
+			conn, err := net.Dial("tcp", addr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return conn, &milterSession{sock: conn}
+		}
+		first, firstClient := dial()
+		if _, err := exchange(firstClient, 'O', optneg(6, OptAllActions, 0)); err != nil {
+			t.Fatal(err)
+		}
+		second, secondClient := dial()
+
+		switch mode {
+		case LimitReject:
+			// the connection above the limit is tempfailed
+			if msg, err := exchange(secondClient, 'O', optneg(6, OptAllActions, 0)); err != nil || msg.Code != 'O' {
+				t.Errorf("Expected negotiation of rejected connection, got %v %v", msg, err)
+			}
+			if msg, err := exchange(secondClient, 'C', connectData("mx.example.com", '4', 25, "192.0.2.1")); err != nil || msg.Code != 't' {
+				t.Errorf("Expected tempfail above the limit, got %v %v", msg, err)
+			}
+			if msg, err := exchange(firstClient, 'H', cstrings("mx.example.com")); err != nil || msg.Code != 'c' {
+				t.Errorf("Expected first connection to continue, got %v %v", msg, err)
+			}
+		case LimitBlock:
+			// the connection above the limit waits for the first one to end
+			second.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+			if _, err := exchange(secondClient, 'O', optneg(6, OptAllActions, 0)); err == nil {
+				t.Error("Expected connection above the limit to wait")
+			}
+			firstClient.WritePacket(&Message{'Q', nil})
+			second.SetReadDeadline(time.Now().Add(5 * time.Second))
+			if msg, err := secondClient.ReadPacket(); err != nil || msg.Code != 'O' {
+				t.Errorf("Expected negotiation once a slot is free, got %v %v", msg, err)
+			}
+		}
+		first.Close()
+		second.Close()
+		server.Close()
+	}
+}
+
+func TestShutdownRejected(t *testing.T) {
+	server := &Server{
+		MilterFactory: func() (Milter, OptAction, OptProtocol) {
+			return &hookMilter{}, 0, 0
+		},
+		Logger:          &testLogger{},
+		MaxConnections:  1,
+		ConnectionLimit: LimitReject,
+	}
+	addr := startTestServer(t, server)
+
+	var conns []net.Conn
+	for i := 0; i < 2; i++ {
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		conns = append(conns, conn)
+		if msg, err := exchange(&milterSession{sock: conn}, 'O', optneg(6, OptAllActions, 0)); err != nil || msg.Code != 'O' {
+			t.Fatalf("Expected negotiation, got %v %v", msg, err)
+		}
+	}
+
+	// the tempfailed connection waits for the MTA like the other one
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != context.DeadlineExceeded {
+		t.Errorf("Expected Shutdown to give up waiting, got %v", err)
+	}
+	for i, conn := range conns {
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+			t.Errorf("Expected connection %d to be closed by Shutdown, got %v", i, err)
+		}
+	}
+}
+
+func TestMaxConnectionsListeners(t *testing.T) {
+	var listeners []net.Listener
+	for i := 0; i < 2; i++ {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		listeners = append(listeners, l)
+	}
+	server := &Server{
+		MilterFactory: func() (Milter, OptAction, OptProtocol) {
+			return &hookMilter{}, 0, 0
+		},
+		Logger:          &testLogger{},
+		Listeners:       listeners,
+		MaxConnections:  1,
+		ConnectionLimit: LimitBlock,
+	}
+	go server.RunServer()
+	defer server.Close()
+
+	dial := func(l net.Listener) (net.Conn, *milterSession) {
+		conn, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		return conn, &milterSession{sock: conn}
+	}
+	// idle listeners hold no slot, each of them can take the only one
+	for _, l := range listeners {
+		conn, client := dial(l)
+		if msg, err := exchange(client, 'O', optneg(6, OptAllActions, 0)); err != nil || msg.Code != 'O' {
+			t.Errorf("%v: expected negotiation, got %v %v", l.Addr(), msg, err)
+		}
+		client.WritePacket(&Message{'Q', nil})
+		conn.Close()
+	}
+
+	// a connection on one listener waits for the one on the other to end
+	first, firstClient := dial(listeners[1])
+	if _, err := exchange(firstClient, 'O', optneg(6, OptAllActions, 0)); err != nil {
+		t.Fatal(err)
+	}
+	second, secondClient := dial(listeners[0])
+	defer second.Close()
+	second.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	if _, err := exchange(secondClient, 'O', optneg(6, OptAllActions, 0)); err == nil {
+		t.Error("Expected connection above the limit to wait")
+	}
+	first.Close()
+	second.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if msg, err := secondClient.ReadPacket(); err != nil || msg.Code != 'O' {
+		t.Errorf("Expected negotiation once a slot is free, got %v %v", msg, err)
+	}
+}
+
+func TestNilLogger(t *testing.T) {
+	server := &Server{
+		MilterFactory: func() (Milter, OptAction, OptProtocol) {
+			return &hookMilter{}, 0, 0
+		},
+	}
+	addr := startTestServer(t, server)
+	defer server.Close()
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	client := &milterSession{sock: conn}
+	if _, err := exchange(client, 'O', optneg(6, OptAllActions, 0)); err != nil {
+		t.Fatal(err)
+	}
+	// unknown commands are logged before the session is closed
+	if msg, err := exchange(client, 'Z', nil); err != io.EOF {
+		t.Errorf("Expected connection to be closed, got %v, %v", msg, err)
+	}
+}
+
+// denyLimiter refuses every connection
+type denyLimiter struct {
+	addrs chan net.Addr
+}
+
+func (l denyLimiter) Allow(addr net.Addr) bool {
+	l.addrs <- addr
+	return false
+}
+
+func TestRateLimiter(t *testing.T) {
+	limiter := denyLimiter{make(chan net.Addr, 1)}
+	server := &Server{
+		MilterFactory: func() (Milter, OptAction, OptProtocol) {
+			t.Error("Expected no session for refused connection")
+			return &hookMilter{}, 0, 0
+		},
+		RateLimiter: limiter,
+	}
+	addr := startTestServer(t, server)
+	defer server.Close()
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if addr := <-limiter.addrs; addr.String() != conn.LocalAddr().String() {
+		t.Errorf("Expected limiter to get %v, got %v", conn.LocalAddr(), addr)
+	}
+	client := &milterSession{sock: conn}
+	if msg, err := exchange(client, 'O', optneg(6, OptAllActions, 0)); err == nil {
+		t.Errorf("Expected connection to be closed, got %v", msg)
+	}
+}
+
+func TestOnConnect(t *testing.T) {
+	logger := &testLogger{}
+	refused := make(chan net.Addr, 1)
+	server := &Server{
+		MilterFactory: func() (Milter, OptAction, OptProtocol) {
+			t.Error("Expected no milter for refused connection")
+			return &hookMilter{}, 0, 0
+		},
+		Logger: logger,
+		OnConnect: func(conn net.Conn) error {
+			refused <- conn.RemoteAddr()
+			return errors.New("blocklisted")
+		},
+	}
+	addr := startTestServer(t, server)
+	defer server.Close()
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if addr := <-refused; addr.String() != conn.LocalAddr().String() {
+		t.Errorf("Expected OnConnect to get %v, got %v", conn.LocalAddr(), addr)
+	}
+	client := &milterSession{sock: conn}
+	if msg, err := exchange(client, 'O', optneg(6, OptAllActions, 0)); err == nil {
+		t.Errorf("Expected connection to be closed, got %v", msg)
+	}
+	if !logger.contains("blocklisted") {
+		t.Errorf("Expected refusal to be logged, got %q", logger.lines)
+	}
+	if n := server.TotalConnections(); n != 0 {
+		t.Errorf("Expected refused connection not to be counted, got %d", n)
+	}
+}
+
+func TestOnConnectShutdown(t *testing.T) {
+	started := make(chan struct{})
+	server := &Server{
+		MilterFactory: func() (Milter, OptAction, OptProtocol) {
+			return &hookMilter{}, 0, 0
+		},
+		Logger: &testLogger{},
+		OnConnect: func(conn net.Conn) error {
+			close(started)
+			// blocks until the connection is closed
+			_, err := conn.Read(make([]byte, 1))
+			return err
+		},
+	}
+	addr := startTestServer(t, server)
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	<-started
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != context.DeadlineExceeded {
+		t.Errorf("Expected Shutdown to give up waiting, got %v", err)
+	}
+	closed := make(chan struct{})
+	go func() {
+		server.Close()
+		close(closed)
+	}()
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected the hook to end once Shutdown closed the connection")
+	}
+}
+
+func TestIdleTimeout(t *testing.T) {
+	reported := make(chan error, 1)
+	logger := &testLogger{}
+	server := &Server{
+		MilterFactory: func() (Milter, OptAction, OptProtocol) {
+			return &hookMilter{}, 0, 0
+		},
+		ErrHandlers: []func(error){func(err error) { reported <- err }},
+		Logger:      logger,
+		IdleTimeout: 50 * time.Millisecond,
+	}
+	addr := startTestServer(t, server)
+	defer server.Close()
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	client := &milterSession{sock: conn}
+	if _, err := exchange(client, 'O', optneg(6, OptAllActions, 0)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := exchange(client, 'M', cstrings("<from@example.com>")); err != nil {
+		t.Fatal(err)
+	}
+
+	// stalling within a message is not idle
+	time.Sleep(150 * time.Millisecond)
+	if msg, err := exchange(client, 'E', nil); err != nil || msg.Code != accept {
+		t.Fatalf("Expected message to be accepted, got %v, %v", msg, err)
+	}
+
+	// after the message the connection is closed
+	if _, err := client.ReadPacket(); err != io.EOF {
+		t.Errorf("Expected connection to be closed, got %v", err)
+	}
+	select {
+	case err := <-reported:
+		t.Errorf("Expected idle connection to be closed without error, got %v", err)
+	default:
+	}
+	server.Close()
+	if !logger.contains("idle") {
+		t.Errorf("Expected idle connection to be logged, got %q", logger.lines)
+	}
+}
+
+func TestMilterAddrFactory(t *testing.T) {
+	addrs := make(chan net.Addr, 1)
+	server := &Server{
+		MilterFactory: func() (Milter, OptAction, OptProtocol) {
+			t.Error("Expected MilterAddrFactory to be used")
+			return &hookMilter{}, 0, 0
+		},
+		MilterAddrFactory: func(addr net.Addr) (Milter, OptAction, OptProtocol) {
+			addrs <- addr
+			return &hookMilter{}, 0, 0
+		},
+		Logger: &testLogger{},
+	}
+	addr := startTestServer(t, server)
+	defer server.Close()
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	client := &milterSession{sock: conn}
+	if _, err := exchange(client, 'O', optneg(6, OptAllActions, 0)); err != nil {
+		t.Fatal(err)
+	}
+	if addr := <-addrs; addr.String() != conn.LocalAddr().String() {
+		t.Errorf("Expected factory to get %v, got %v", conn.LocalAddr(), addr)
+	}
+}
+
+func TestListeners(t *testing.T) {
+	tcp, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir, err := ioutil.TempDir("", "milter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	unix, err := net.Listen("unix", filepath.Join(dir, "milter.sock"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &Server{
+		MilterFactory: func() (Milter, OptAction, OptProtocol) {
+			return &hookMilter{}, 0, 0
+		},
+		Logger:    &testLogger{},
+		Listeners: []net.Listener{tcp, unix},
+	}
+	served := make(chan error, 1)
+	go func() { served <- server.RunServer() }()
+
+	for _, l := range []net.Listener{tcp, unix} {
+		conn, err := net.Dial(l.Addr().Network(), l.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		client := &milterSession{sock: conn}
+		if msg, err := exchange(client, 'O', optneg(6, OptAllActions, 0)); err != nil || msg.Code != 'O' {
+			t.Errorf("%s: expected negotiation, got %v %v", l.Addr().Network(), msg, err)
+		}
+		conn.Close()
+	}
+
+	server.Close()
+	if err := <-served; err != nil {
+		t.Errorf("Expected RunServer to return once closed, got %v", err)
+	}
+	if _, err := net.Dial("tcp", tcp.Addr().String()); err == nil {
+		t.Error("Expected TCP listener to be closed")
+	}
+}
+
+func TestServerCounters(t *testing.T) {
+	server := &Server{
+		MilterFactory: func() (Milter, OptAction, OptProtocol) {
+			return &hookMilter{}, 0, 0
+		},
+		Logger: &testLogger{},
+	}
+	addr := startTestServer(t, server)
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := &milterSession{sock: conn}
+	if _, err := exchange(client, 'O', optneg(6, OptAllActions, 0)); err != nil {
+		t.Fatal(err)
+	}
+	// two messages, the first one is aborted
+	exchange(client, 'M', cstrings("<from@example.com>"))
+	client.WritePacket(&Message{'A', nil})
+	if _, err := exchange(client, 'M', cstrings("<from@example.com>")); err != nil {
+		t.Fatal(err)
+	}
+	if active, total, messages := server.ActiveConnections(), server.TotalConnections(), server.TotalMessages(); active != 1 || total != 1 || messages != 2 {
+		t.Errorf("Got %d active and %d total connections, %d messages", active, total, messages)
+	}
+	conn.Close()
+	server.Close()
+	if active := server.ActiveConnections(); active != 0 {
+		t.Errorf("Expected no active connections after close, got %d", active)
+	}
+}
+
+func TestServeConn(t *testing.T) {
+	var helo string
+	init := func() (Milter, OptAction, OptProtocol) {
+		return &hookMilter{
+			helo: func(name string, m *Modifier) (Response, error) {
+				helo = name
+				return RespContinue, nil
+			},
+		}, OptAddHeader, 0
+	}
+	sock := &bufferSock{}
+	sock.send('O', optneg(6, OptAddHeader|OptChangeHeader, 0))
+	sock.send('H', cstrings("mail.example.com"))
+	sock.send('Q', nil)
+	ServeConn(sock, init, nil)
+
+	if helo != "mail.example.com" {
+		t.Errorf("Expected Helo with mail.example.com, got %q", helo)
+	}
+	replies := sock.replies(t)
+	if len(replies) != 2 || replies[0].Code != 'O' || replies[1].Code != 'c' {
+		t.Fatalf("Got replies %v", replies)
+	}
+	if !bytes.Equal(replies[0].Data, optneg(6, OptAddHeader, 0)) {
+		t.Errorf("Got negotiation reply %v", replies[0].Data)
+	}
+	if !sock.closed {
+		t.Error("Expected conn to be closed")
+	}
+}
+
+// temporaryError is a net.Error such as EMFILE from Accept
+type temporaryError struct{}
+
+func (temporaryError) Error() string   { return "too many open files" }
+func (temporaryError) Timeout() bool   { return false }
+func (temporaryError) Temporary() bool { return true }
+
+// failingListener fails the first failures calls of Accept with a temporary error,
+// the following ones with permanent if set
+type failingListener struct {
+	net.Listener
+	failures  int32
+	permanent error
+}
+
+func (l *failingListener) Accept() (net.Conn, error) {
+	if atomic.AddInt32(&l.failures, -1) >= 0 {
+		return nil, temporaryError{}
+	}
+	if l.permanent != nil {
+		return nil, l.permanent
+	}
+	return l.Listener.Accept()
+}
+
+func TestAcceptTemporaryError(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	logger := &testLogger{}
+	server := &Server{
+		MilterFactory: func() (Milter, OptAction, OptProtocol) {
+			return &hookMilter{}, 0, 0
+		},
+		Logger:   logger,
+		Listener: &failingListener{Listener: listener, failures: 3},
+	}
+	served := make(chan error, 1)
+	go func() { served <- server.RunServer() }()
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := &milterSession{sock: conn}
+	if msg, err := exchange(client, 'O', optneg(6, OptAllActions, 0)); err != nil || msg.Code != 'O' {
+		t.Errorf("Expected negotiation after retrying, got %v %v", msg, err)
+	}
+	conn.Close()
+
+	server.Close()
+	if err := <-served; err != nil {
+		t.Errorf("Expected RunServer to return once closed, got %v", err)
+	}
+	for _, delay := range []string{"5ms", "10ms", "20ms"} {
+		if !logger.contains("retrying in " + delay) {
+			t.Errorf("Expected retry after %s to be logged, got %q", delay, logger.lines)
+		}
+	}
+
+	// permanent errors end serving and are returned
+	permanent := &os.SyscallError{Syscall: "accept", Err: syscall.EBADF}
+	server = &Server{
+		MilterFactory: func() (Milter, OptAction, OptProtocol) {
+			return &hookMilter{}, 0, 0
+		},
+		Logger:   &testLogger{},
+		Listener: &failingListener{Listener: listener, failures: 1, permanent: permanent},
+	}
+	if err := server.RunServer(); err != permanent {
+		t.Errorf("Expected RunServer to return %v, got %v", permanent, err)
+	}
+}
+
+func TestServeConnInitPanic(t *testing.T) {
+	var reported error
+	init := func() (Milter, OptAction, OptProtocol) {
+		panic("no configuration")
+	}
+	sock := &bufferSock{}
+	sock.send('O', optneg(6, OptAddHeader, 0))
+	ServeConn(sock, init, nil, func(err error) { reported = err })
+
+	if reported == nil || !strings.Contains(reported.Error(), "no configuration") {
+		t.Errorf("Expected the panic to be reported, got %v", reported)
+	}
+	if !sock.closed {
+		t.Error("Expected connection to be closed")
+	}
+}
+
+func TestServeConnContextDelay(t *testing.T) {
+	init := func() (Milter, OptAction, OptProtocol) {
+		return &hookMilter{
+			helo: func(name string, m *Modifier) (Response, error) {
+				m.Delay(time.Hour)
+				return RespContinue, nil
+			},
+		}, 0, 0
+	}
+	conn, clientConn := net.Pipe()
+	defer clientConn.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		// hide net.Conn, the delay can not watch the connection then
+		ServeConnContext(ctx, struct{ io.ReadWriteCloser }{conn}, init, nil)
+		close(done)
+	}()
+	client := &milterSession{sock: clientConn}
+	if err := client.WritePacket(&Message{'H', cstrings("abuser")}); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(20 * time.Millisecond)
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected delay to end when ctx is cancelled")
+	}
+}
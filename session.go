@@ -1,13 +1,16 @@
 package milter
 
 import (
-	"bufio"
 	"bytes"
 	"encoding/binary"
 	"io"
 	"net"
 	"net/textproto"
+	"runtime/debug"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
 // OptAction sets which actions the milter wants to perform.
@@ -58,74 +61,321 @@ const (
 	OptMDS1M        OptProtocol = 0x20000000 /* SMFIP_MDS_1M MILTER_MAX_DATA_SIZE=1M */
 )
 
+// Define the stages of Modifier.SetSymList
+const (
+	SymListConnect  = iota /* SMFIM_CONNECT */
+	SymListHelo            /* SMFIM_HELO */
+	SymListMailFrom        /* SMFIM_ENVFROM */
+	SymListRcptTo          /* SMFIM_ENVRCPT */
+	SymListData            /* SMFIM_DATA */
+	SymListEOM             /* SMFIM_EOM */
+	SymListEOH             /* SMFIM_EOH */
+)
+
 // milterSession keeps session state during MTA communication
 type milterSession struct {
+	// number of commands processed, first for 64-bit alignment of atomic access.
+	// Modifiers of earlier commands are expired
+	command uint64
+
 	actions  OptAction
 	protocol OptProtocol
 	sock     io.ReadWriteCloser
+	frame    []byte
+	writeErr error
 	headers  textproto.MIMEHeader
 	macros   map[string]string
 	milter   Milter
 	logger   Logger
+
+	// macros of the last SMFIC_MACRO of every stage, keyed by its command code
+	stageMacros map[byte]map[string]string
+
+	// serializes writes of callbacks and automatic progress reports
+	writeMu sync.Mutex
+
+	// options offered by the MTA in SMFIC_OPTNEG
+	mtaActions  OptAction
+	mtaProtocol OptProtocol
+	version     uint32
+
+	// macro lists set with Modifier.SetSymList while negotiating, by stage
+	negotiating bool
+	symLists    map[int]string
+
+	// stage of the command being processed
+	stage Stage
+
+	// number of messages started in this session and in the ones ended by
+	// SMFIC_QUIT_NC before on the connection
+	messages, earlierMessages int
+
+	// optional session and message IDs
+	sessionID, messageID string
+	newSessionID         func() string
+	newMessageID         func() string
+
+	// delay of the next reply set by Modifier.Delay
+	delay time.Duration
+	// data read ahead while waiting to reply
+	peeked []byte
+
+	// connection information and last HELO name
+	host, family string
+	port         uint16
+	addr         net.IP
+	socketPath   string
+	helo         string
+
+	// envelope of the current message
+	sender, rawSender string
+	recipients        []string
+	// macros sent with the RCPT of each recipient in recipients
+	recipientMacros map[string]map[string]string
+	// ESMTP arguments of MAIL FROM, sent along by Modifier.ChangeFrom
+	senderArgs []string
+
+	// headers in the order received and exactly as sent
+	rawHeaders []RawHeader
+	// header values are passed to Header unfolded
+	unfoldHeaders bool
+
+	// replacement body collected by Modifier.ReplaceBody
+	newBody []byte
+
+	// number of body bytes received
+	bodySize int64
+	// the milter asked to skip the rest of the body
+	skipBody bool
+
+	// body collected for Modifier.BodyReader when bufferBody is set, it is
+	// dropped if it grows beyond maxBodySize
+	bufferBody   bool
+	maxBodySize  int64
+	body         []byte
+	bodyOverflow bool
+
+	// splits body chunks into lines when set by Modifier.BodyLines
+	bodyLines *lineWriter
+
+	onNoActions   func(wanted OptAction) error
+	onHealthCheck func()
+
+	requiredActions  OptAction
+	requiredProtocol OptProtocol
+
+	panicResponse Response
+	errorResponse func(stage Stage, err error) Response
+	disposition   Response
+	maxDataSize   uint32
+
+	// recover panics of each command instead of ending the session
+	recoverPerCommand bool
+
+	// pass zero-length body chunks to BodyChunk
+	deliverEmptyChunks bool
+
+	// messages counter of the server
+	totalMessages *uint64
+
+	// interval of progress reports sent while the milter works on a reply
+	autoProgressInterval time.Duration
+
+	// deadlines of each packet read and written on network connections
+	readTimeout, writeTimeout time.Duration
+	errHandlers               []func(error)
+
+	// deadline waiting for the next message instead of readTimeout, idle is set
+	// while no message is in progress
+	idleTimeout time.Duration
+	idle        bool
+
+	metrics Metrics
+
+	// envelope addresses are passed on without lower casing them
+	preserveAddressCase bool
+
+	// limit of the time spent on the current message, messageDeadline is set
+	// at MAIL FROM
+	messageTimeout  time.Duration
+	messageDeadline time.Time
+
+	// closed when the session is to end, e.g. by the server shutting down
+	done <-chan struct{}
 }
 
 // ReadPacket reads incoming milter packet
 func (c *milterSession) ReadPacket() (*Message, error) {
-	// read packet length
-	var length uint32
-	if err := binary.Read(c.sock, binary.BigEndian, &length); err != nil {
-		return nil, err
+	// bytes read while sleeping come first
+	var sock io.Reader = c.sock
+	if len(c.peeked) != 0 {
+		sock = io.MultiReader(bytes.NewReader(c.peeked), c.sock)
+		c.peeked = nil
+	}
+	timeout := c.readTimeout
+	if c.idle && c.idleTimeout > 0 {
+		timeout = c.idleTimeout
+	}
+	if conn, ok := c.sock.(net.Conn); ok && (timeout > 0 || c.idleTimeout > 0) {
+		// an idle deadline must not stay in place for the rest of the message
+		var deadline time.Time
+		if timeout > 0 {
+			deadline = time.Now().Add(timeout)
+		}
+		if err := conn.SetReadDeadline(deadline); err != nil {
+			return nil, err
+		}
 	}
+	// refuse to allocate more than the peer may send
+	return ReadMessage(sock, c.maxPacketSize())
+}
+
+// defaultMaxBodySize limits buffered bodies unless MaxBodySize is set, it matches
+// the default message size limit of postfix
+const defaultMaxBodySize = 10240000
 
-	// read packet data
-	data := make([]byte, length)
-	if _, err := io.ReadFull(c.sock, data); err != nil {
-		return nil, err
+// maxBufferedBody returns the largest body buffered for Modifier.BodyReader
+func (c *milterSession) maxBufferedBody() int64 {
+	if c.maxBodySize > 0 {
+		return c.maxBodySize
 	}
+	return defaultMaxBodySize
+}
 
-	// prepare response data
-	message := Message{
-		Code: data[0],
-		Data: data[1:],
+// rcptRejected reports whether the MTA already refused the current recipient, with
+// OptRcptRej sendmail passes these with the {rcpt_mailer} macro set to "error"
+func (m *milterSession) rcptRejected() bool {
+	return m.negotiatedProtocol()&OptRcptRej != 0 && m.stageMacros['R']["{rcpt_mailer}"] == "error"
+}
+
+// maxPacketSize returns the largest packet data size accepted from the MTA, without
+// MaxDataSize it follows the negotiated MILTER_MAX_DATA_SIZE
+func (c *milterSession) maxPacketSize() uint32 {
+	switch {
+	case c.maxDataSize > 0:
+		return c.maxDataSize
+	case c.negotiatedProtocol()&OptMDS1M != 0:
+		return 1024 * 1024
+	default:
+		return 256 * 1024
 	}
+}
 
-	return &message, nil
+// maxReplySize returns the largest packet data size the MTA accepts, which is
+// MILTER_MAX_DATA_SIZE unless a larger size was negotiated
+func (m *milterSession) maxReplySize() int {
+	switch p := m.negotiatedProtocol(); {
+	case p&OptMDS1M != 0:
+		return 1024 * 1024
+	case p&OptMDS256K != 0:
+		return 256 * 1024
+	default:
+		return 64*1024 - 1
+	}
+}
+
+// writeBody sends a replacement body with write in as many packets as the MTA needs
+func (m *milterSession) writeBody(write func(*Message) error, body []byte) error {
+	for size := m.maxReplySize(); len(body) != 0; {
+		if size > len(body) {
+			size = len(body)
+		}
+		if err := write(NewResponse('b', body[:size]).Response()); err != nil {
+			return err
+		}
+		body = body[size:]
+	}
+	return nil
 }
 
 // WritePacket sends a milter response packet to socket stream
 func (m *milterSession) WritePacket(msg *Message) error {
-	buffer := bufio.NewWriter(m.sock)
-
-	// calculate and write response length
-	length := uint32(len(msg.Data) + 1)
-	if err := binary.Write(buffer, binary.BigEndian, length); err != nil {
+	m.writeMu.Lock()
+	defer m.writeMu.Unlock()
+	if err := m.prepareWrite(); err != nil {
 		return err
 	}
+	// the frame buffer is kept for the whole session
+	var err error
+	if m.frame, err = writeMessage(m.sock, m.frame, msg); err != nil {
+		m.writeErr = err
+	}
+	return err
+}
 
-	// write response code
-	if err := buffer.WriteByte(msg.Code); err != nil {
-		return err
+// prepareWrite sets the write deadline, writeMu must be held
+func (m *milterSession) prepareWrite() error {
+	if conn, ok := m.sock.(net.Conn); ok && m.writeTimeout > 0 {
+		if err := conn.SetWriteDeadline(time.Now().Add(m.writeTimeout)); err != nil {
+			return err
+		}
 	}
+	// the MTA would misread anything following a partial frame
+	return m.writeErr
+}
 
-	// write response data
-	if _, err := buffer.Write(msg.Data); err != nil {
+// writeFrames sends packets encoded by Modifier.Batch in a single write
+func (m *milterSession) writeFrames(frames []byte) error {
+	m.writeMu.Lock()
+	defer m.writeMu.Unlock()
+	if err := m.prepareWrite(); err != nil {
 		return err
 	}
-
-	// flush data to network socket stream
-	if err := buffer.Flush(); err != nil {
+	if err := writeFull(m.sock, frames); err != nil {
+		m.writeErr = err
 		return err
 	}
-
 	return nil
 }
 
 // Process processes incoming milter commands
 func (m *milterSession) Process(msg *Message) (Response, error) {
+	defer atomic.AddUint64(&m.command, 1)
+	if m.metrics == nil {
+		return m.process(msg)
+	}
+	start := time.Now()
+	resp, err := m.process(msg)
+	// closing the session on request is no failure
+	failure := err
+	if failure == ErrCloseSession {
+		failure = nil
+	}
+	m.metrics.CommandProcessed(msg.Code, time.Since(start), failure)
+	return resp, err
+}
+
+// process is processCommand tempfailing the commands of a message once it took
+// longer than messageTimeout, rejections are kept
+func (m *milterSession) process(msg *Message) (Response, error) {
+	if m.messageTimeout <= 0 || !strings.ContainsRune("MRTLNBE", rune(msg.Code)) {
+		return m.processCommand(msg)
+	}
+	if msg.Code != 'M' && m.messageExpired() {
+		return RespTempFail, nil
+	}
+	resp, err := m.processCommand(msg)
+	if err == nil && resp != nil && !rejected(resp) && m.messageExpired() {
+		logWarn(m.logger, "Message exceeded timeout of %v at %c command, tempfailing", m.messageTimeout, msg.Code)
+		resp = RespTempFail
+	}
+	return resp, err
+}
+
+// messageExpired reports whether the current message passed messageDeadline
+func (m *milterSession) messageExpired() bool {
+	return !m.messageDeadline.IsZero() && time.Now().After(m.messageDeadline)
+}
+
+func (m *milterSession) processCommand(msg *Message) (Response, error) {
 	switch msg.Code {
 	case 'A':
+		// let the milter release message resources while the message state is intact
+		if a, ok := m.milter.(AbortMilter); ok {
+			a.Abort(newModifier(m))
+		}
 		// abort current message and start over
-		m.headers = nil
+		m.resetMessage()
 		// macros is valid across messages
 
 		// do not send response
@@ -138,27 +388,48 @@ func (m *milterSession) Process(msg *Message) (Response, error) {
 		return nil, nil
 
 	case 'B':
+		m.stage = StageBody
 		// body chunk
-		return m.milter.BodyChunk(msg.Data, newModifier(m))
+		m.bodySize += int64(len(msg.Data))
+		// chunks sent before the MTA saw the skip are not passed on
+		if m.skipBody {
+			return RespContinue, nil
+		}
+		if len(msg.Data) == 0 && !m.deliverEmptyChunks {
+			return RespContinue, nil
+		}
+		if m.bodyLines != nil {
+			m.bodyLines.Write(msg.Data)
+		}
+		if m.bufferBody && !m.bodyOverflow {
+			if m.bodySize > m.maxBufferedBody() {
+				logWarn(m.logger, "Body exceeds %d bytes, sending tempfail", m.maxBufferedBody())
+				m.body, m.bodyOverflow = nil, true
+				return RespTempFail, nil
+			}
+			m.body = append(m.body, msg.Data...)
+		}
+		resp, err := m.milter.BodyChunk(msg.Data, newModifier(m))
+		if err == nil && resp != nil && resp.Response().Code == skip {
+			if m.negotiatedProtocol()&OptSkip == 0 {
+				logWarn(m.logger, "Skip was not negotiated, continuing instead")
+				return RespContinue, nil
+			}
+			m.skipBody = true
+		}
+		return resp, err
 
 	case 'C':
+		m.stage = StageConnect
 		// new connection, get hostname
 		Hostname := readCString(msg.Data)
+		if len(Hostname)+1 >= len(msg.Data) {
+			return nil, &ProtocolError{msg.Code, "missing protocol family"}
+		}
 		msg.Data = msg.Data[len(Hostname)+1:]
 		// get protocol family
 		protocolFamily := msg.Data[0]
 		msg.Data = msg.Data[1:]
-		// get port
-		var Port uint16
-		if protocolFamily == '4' || protocolFamily == '6' {
-			if len(msg.Data) < 2 {
-				return RespTempFail, nil
-			}
-			Port = binary.BigEndian.Uint16(msg.Data)
-			msg.Data = msg.Data[2:]
-		}
-		// get address
-		Address := readCString(msg.Data)
 		// convert address and port to human readable string
 		family := map[byte]string{
 			'U': "unknown",
@@ -166,13 +437,26 @@ func (m *milterSession) Process(msg *Message) (Response, error) {
 			'4': "tcp4",
 			'6': "tcp6",
 		}
+		m.host, m.family, m.port = Hostname, family[protocolFamily], 0
+		m.addr, m.socketPath = nil, ""
+		// unknown connections, e.g. mail submitted locally by sendmail, carry no
+		// port and address, anything following the family is ignored
+		if protocolFamily != 'U' {
+			// get port, it is sent as zero for unix sockets
+			if len(msg.Data) < 2 {
+				return nil, &ProtocolError{msg.Code, "missing port"}
+			}
+			m.port = binary.BigEndian.Uint16(msg.Data)
+			// get address, unix sockets have a path instead of an IP address
+			Address := readCString(msg.Data[2:])
+			if protocolFamily == 'L' {
+				m.socketPath = Address
+			} else {
+				m.addr = parseAddress(Address)
+			}
+		}
 		// run handler and return
-		return m.milter.Connect(
-			Hostname,
-			family[protocolFamily],
-			Port,
-			net.ParseIP(Address),
-			newModifier(m))
+		return m.milter.Connect(m.host, m.family, m.port, m.addr, newModifier(m))
 
 	case 'D':
 		// define/update macros
@@ -180,76 +464,172 @@ func (m *milterSession) Process(msg *Message) (Response, error) {
 			m.macros = make(map[string]string)
 		}
 
+		if len(msg.Data) == 0 {
+			return nil, &ProtocolError{msg.Code, "macros without command code"}
+		}
 		// convert data to Go strings
-		data := decodeCStrings(msg.Data[1:])
+		data := decodeMacros(msg.Data[1:])
 		if len(data) != 0 {
-			// store data in a map
-			for i := 0; i < len(data); i += 2 {
+			// merge into the macros of earlier stages, e.g. the queue id {i}
+			// is sent before SMFIC_BODYEOB
+			for i := 0; i+1 < len(data); i += 2 {
 				m.macros[data[i]] = data[i+1]
 			}
 		}
+		// and replace the macros of this stage, e.g. those of the previous RCPT
+		if m.stageMacros == nil {
+			m.stageMacros = make(map[byte]map[string]string)
+		}
+		stage := make(map[string]string, len(data)/2)
+		for i := 0; i+1 < len(data); i += 2 {
+			stage[data[i]] = data[i+1]
+		}
+		m.stageMacros[msg.Data[0]] = stage
 		// do not send response
 		return nil, nil
 
 	case 'E':
-		// call and return milter handler
-		return m.milter.Body(newModifier(m))
+		m.stage = StageEOM
+		// deliver the last line if it was not terminated
+		if m.bodyLines != nil {
+			m.bodyLines.Flush()
+		}
+		// the MTA may have ignored the tempfail sent for the chunk
+		if m.bodyOverflow {
+			return RespTempFail, nil
+		}
+		// call milter handler, the end of a message needs a final response
+		resp, err := m.milter.Body(newModifier(m))
+		if err == nil && (resp == nil || resp.Response().Code == continue_) {
+			disposition := m.disposition
+			if disposition == nil {
+				disposition = RespAccept
+			}
+			logWarn(m.logger, "Body returned no final response, sending %c", disposition.Response().Code)
+			if closing(resp) {
+				disposition = CloseConnection(disposition)
+			}
+			resp = disposition
+		}
+		// the body is only replaced if the milter provided a new one and the message
+		// is accepted, a rejected or discarded message keeps its body
+		newBody := m.newBody
+		m.newBody = nil
+		if err == nil && len(newBody) != 0 {
+			if code := resp.Response().Code; code == accept || code == continue_ {
+				err = m.writeBody(m.WritePacket, newBody)
+			}
+		}
+		return resp, err
 
 	case 'H':
+		m.stage = StageHelo
 		// helo command
-		name := strings.TrimSuffix(string(msg.Data), null)
-		return m.milter.Helo(name, newModifier(m))
+		m.helo = strings.TrimSuffix(string(msg.Data), null)
+		return m.milter.Helo(m.helo, newModifier(m))
 
 	case 'L':
+		m.stage = StageHeader
 		// make sure headers is initialized
 		if m.headers == nil {
 			m.headers = make(textproto.MIMEHeader)
 		}
-		// add new header to headers map
-		HeaderData := decodeCStrings(msg.Data)
-		if len(HeaderData) == 2 {
-			m.headers.Add(HeaderData[0], HeaderData[1])
-			// call and return milter handler
-			return m.milter.Header(HeaderData[0], HeaderData[1], newModifier(m))
+		// add new header to headers map, the value may be empty
+		name := readCString(msg.Data)
+		if name == "" || len(name) == len(msg.Data) {
+			return nil, &ProtocolError{msg.Code, "header without name and value"}
+		}
+		value := readCString(msg.Data[len(name)+1:])
+		// only NUL padding may follow the value, milterclient sends one more
+		if extra := msg.Data[len(name)+1:]; len(value) < len(extra) && len(bytes.Trim(extra[len(value):], null)) != 0 {
+			return nil, &ProtocolError{msg.Code, "header with more than name and value"}
 		}
+		m.rawHeaders = append(m.rawHeaders, RawHeader{name, value})
+		if m.unfoldHeaders {
+			value = unfold(value)
+		}
+		m.headers.Add(name, value)
+		// call and return milter handler
+		return m.milter.Header(name, value, newModifier(m))
 
 	case 'M':
+		m.stage = StageMailFrom
+		m.resetMessage()
+		if m.messageTimeout > 0 {
+			m.messageDeadline = time.Now().Add(m.messageTimeout)
+		}
+		m.messages++
+		if m.totalMessages != nil {
+			atomic.AddUint64(m.totalMessages, 1)
+		}
+		if m.newMessageID != nil {
+			m.messageID = m.newMessageID()
+		}
 		m.milter.NewMessage()
 		// envelope from address
-		envfrom := readCString(msg.Data)
-		return m.milter.MailFrom(strings.ToLower(strings.Trim(envfrom, "<>")), newModifier(m))
+		m.rawSender, m.senderArgs = decodeEnvelope(msg.Data)
+		m.sender = m.address(m.rawSender)
+		return m.milter.MailFrom(m.sender, append([]string(nil), m.senderArgs...), newModifier(m))
 
 	case 'N':
+		m.stage = StageEOH
 		// end of headers
 		return m.milter.Headers(m.headers, newModifier(m))
 
 	case 'O':
-		// ignore request and prepare response buffer
-		buffer := new(bytes.Buffer)
-		// prepare response data
-		for _, value := range []uint32{2, uint32(m.actions), uint32(m.protocol)} {
-			if err := binary.Write(buffer, binary.BigEndian, value); err != nil {
-				return nil, err
-			}
-		}
-		// build and send packet
-		return NewResponse('O', buffer.Bytes()), nil
+		// option negotiation
+		return m.negotiate(msg.Data)
 
 	case 'Q':
 		// client requested session close
 		return nil, ErrCloseSession
 
+	case 'K':
+		// the session ends but the MTA goes on with a new one on the connection,
+		// the negotiated options are kept
+		m.resetSession()
+		return nil, nil
+
 	case 'R':
+		m.stage = StageRcptTo
 		// envelope to address
-		envto := readCString(msg.Data)
-		return m.milter.RcptTo(strings.ToLower(strings.Trim(envto, "<>")), newModifier(m))
+		envto, args := decodeEnvelope(msg.Data)
+		rcpt := m.address(envto)
+		resp, err := m.milter.RcptTo(rcpt, args, newModifier(m))
+		// keep track of the recipients neither the MTA nor the milter refused
+		if err == nil && !rejected(resp) && !m.rcptRejected() {
+			m.recipients = append(m.recipients, rcpt)
+			// the macros of the stage are replaced by the next RCPT
+			if m.recipientMacros == nil {
+				m.recipientMacros = make(map[string]map[string]string)
+			}
+			macros := make(map[string]string, len(m.stageMacros['R']))
+			for name, value := range m.stageMacros['R'] {
+				macros[name] = value
+			}
+			m.recipientMacros[rcpt] = macros
+		}
+		// the macros of a RCPT do not apply to the next one if it comes without
+		delete(m.stageMacros, 'R')
+		return resp, err
+
+	case 'U':
+		m.stage = StageUnknown
+		// unknown SMTP command
+		if u, ok := m.milter.(UnknownMilter); ok {
+			return u.Unknown(readCString(msg.Data), newModifier(m))
+		}
 
 	case 'T':
-		// data, ignore
+		m.stage = StageData
+		// data command
+		if d, ok := m.milter.(DataMilter); ok {
+			return d.Data(newModifier(m))
+		}
 
 	default:
 		// print error and close session
-		m.logger.Printf("Unrecognized command code: %c", msg.Code)
+		logDebug(m.logger, "Unrecognized command code: %c", msg.Code)
 		return nil, ErrCloseSession
 	}
 
@@ -257,41 +637,428 @@ func (m *milterSession) Process(msg *Message) (Response, error) {
 	return RespContinue, nil
 }
 
+// resetMessage clears all message specific state
+func (m *milterSession) resetMessage() {
+	m.headers = nil
+	m.rawHeaders = nil
+	m.bodyLines = nil
+	m.newBody = nil
+	m.bodySize = 0
+	m.skipBody = false
+	m.body, m.bodyOverflow = nil, false
+	m.messageID = ""
+	m.sender, m.rawSender, m.recipients = "", "", nil
+	m.recipientMacros = nil
+	m.messageDeadline = time.Time{}
+	m.senderArgs = nil
+}
+
+// resetSession clears all session specific state
+func (m *milterSession) resetSession() {
+	m.resetMessage()
+	m.macros, m.stageMacros = nil, nil
+	m.stage = StageNone
+	m.host, m.family, m.port, m.addr, m.socketPath = "", "", 0, nil, ""
+	m.helo = ""
+}
+
+// negotiatedProtocol returns the protocol options both the milter and the MTA agreed on
+func (m *milterSession) negotiatedProtocol() OptProtocol {
+	return m.protocol & m.mtaProtocol
+}
+
+// noReplyOptions maps commands to the option telling the MTA not to expect a reply,
+// the end of a message always needs one
+var noReplyOptions = map[byte]OptProtocol{
+	'B': OptNrBody,
+	'C': OptNrConn,
+	'H': OptNrHelo,
+	'L': OptNrHdr,
+	'M': OptNrMailFrom,
+	'N': OptNrEOH,
+	'R': OptNrRcptTo,
+	'T': OptNrData,
+	'U': OptNrUnknown,
+}
+
+// noReply reports whether the reply to command code was negotiated away
+func (m *milterSession) noReply(code byte) bool {
+	opt, ok := noReplyOptions[code]
+	return ok && m.negotiatedProtocol()&opt != 0
+}
+
+// address strips the angle brackets of an envelope address, lower casing it unless
+// preserveAddressCase is set
+func (m *milterSession) address(addr string) string {
+	addr = strings.Trim(addr, "<>")
+	if m.preserveAddressCase {
+		return addr
+	}
+	return strings.ToLower(addr)
+}
+
+// unfold joins the lines of a folded header value, each line break and the
+// whitespace following it become a single space
+func unfold(value string) string {
+	if !strings.ContainsAny(value, "\r\n") {
+		return value
+	}
+	var b strings.Builder
+	for i := 0; i < len(value); i++ {
+		c := value[i]
+		if c != '\r' && c != '\n' {
+			b.WriteByte(c)
+			continue
+		}
+		// skip the rest of the line break and the indentation of the next line
+		for i+1 < len(value) && strings.IndexByte("\r\n \t", value[i+1]) >= 0 {
+			i++
+		}
+		b.WriteByte(' ')
+	}
+	return b.String()
+}
+
+// maxProtocolVersion is the latest milter protocol version understood, MTAs
+// offering a later one are answered with it
+const maxProtocolVersion = 6
+
+// negotiate records the options offered by the MTA and replies with the milter's options
+func (m *milterSession) negotiate(data []byte) (Response, error) {
+	// very old clients send no offer at all and take the actions they get
+	m.version = 2
+	m.mtaActions = m.actions
+	if len(data) != 0 {
+		if len(data) < 12 {
+			return nil, ErrNegotiationMalformed
+		}
+		m.version = binary.BigEndian.Uint32(data)
+		if m.version < 2 {
+			return nil, ErrNegotiationVersion
+		}
+		if m.version > maxProtocolVersion {
+			m.version = maxProtocolVersion
+		}
+		m.mtaActions = OptAction(binary.BigEndian.Uint32(data[4:]))
+		m.mtaProtocol = OptProtocol(binary.BigEndian.Uint32(data[8:]))
+		// refuse MTAs lacking what the milter can not do without
+		missingActions := m.requiredActions &^ m.mtaActions
+		missingProtocol := m.requiredProtocol &^ m.mtaProtocol
+		if missingActions != 0 || missingProtocol != 0 {
+			logWarn(m.logger, "MTA lacks required actions %#x and protocol options %#x", missingActions, missingProtocol)
+			return nil, ErrNegotiationRequired
+		}
+		// every modification would be refused by the MTA
+		if m.mtaActions == 0 && m.actions != 0 && m.onNoActions != nil {
+			if err := m.onNoActions(m.actions); err != nil {
+				return nil, err
+			}
+		}
+		// let the milter adjust its options to the offer
+		if n, ok := m.milter.(NegotiateMilter); ok {
+			m.negotiating = true
+			actions, protocol := n.Negotiate(m.mtaActions, m.mtaProtocol, newModifier(m))
+			m.negotiating = false
+			if len(m.symLists) != 0 {
+				actions |= OptSetSymList
+			}
+			m.actions, m.protocol = actions&m.mtaActions, protocol&m.mtaProtocol
+		}
+	}
+	// prepare response buffer
+	buffer := new(bytes.Buffer)
+	// prepare response data
+	for _, value := range []uint32{m.version, uint32(m.actions), uint32(m.protocol)} {
+		if err := binary.Write(buffer, binary.BigEndian, value); err != nil {
+			return nil, err
+		}
+	}
+	// requested macro lists follow the options
+	for stage := SymListConnect; stage <= SymListEOH; stage++ {
+		if list, ok := m.symLists[stage]; ok {
+			if err := binary.Write(buffer, binary.BigEndian, uint32(stage)); err != nil {
+				return nil, err
+			}
+			buffer.WriteString(list + null)
+		}
+	}
+	// build and send packet
+	return NewResponse('O', buffer.Bytes()), nil
+}
+
+// sleep waits for d, returning early with an error if the MTA closes the connection
+// or done is closed. The connection can only be watched if the socket is a net.Conn
+func (m *milterSession) sleep(d time.Duration) error {
+	conn, ok := m.sock.(net.Conn)
+	if !ok {
+		timer := time.NewTimer(d)
+		defer timer.Stop()
+		select {
+		case <-timer.C:
+			return nil
+		case <-m.done:
+			// like a closed connection
+			return io.EOF
+		}
+	}
+	// the MTA does not send anything while it waits for the reply, a read
+	// only returns if the connection is closed
+	conn.SetReadDeadline(time.Time{})
+	type result struct {
+		b   byte
+		err error
+	}
+	done := make(chan result, 1)
+	go func() {
+		var b [1]byte
+		_, err := io.ReadFull(conn, b[:])
+		done <- result{b[0], err}
+	}()
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	var r result
+	select {
+	case r = <-done:
+	case <-m.done:
+		conn.Close()
+		r = <-done
+	case <-timer.C:
+		// stop the pending read
+		conn.SetReadDeadline(time.Now())
+		r = <-done
+		conn.SetReadDeadline(time.Time{})
+		if err, ok := r.err.(net.Error); ok && err.Timeout() {
+			return nil
+		}
+	}
+	if r.err != nil {
+		return r.err
+	}
+	// keep the start of a command sent anyway
+	m.peeked = append(m.peeked, r.b)
+	return nil
+}
+
+// parseAddress parses the connection address, sendmail prefixes IPv6
+// addresses with "IPv6:"
+func parseAddress(address string) net.IP {
+	if len(address) > 5 && strings.EqualFold(address[:5], "IPv6:") {
+		address = address[5:]
+	}
+	return net.ParseIP(address)
+}
+
+// report passes read and write timeouts, malformed packets and protocol errors on to the
+// error handlers
+func (m *milterSession) report(err error) {
+	switch err := err.(type) {
+	case net.Error:
+		if !err.Timeout() {
+			return
+		}
+	case *ProtocolError:
+	default:
+		// packets the MTA can not have framed correctly
+		if err != ErrPacketTooLarge && err != ErrPacketEmpty {
+			return
+		}
+	}
+	for _, f := range m.errHandlers {
+		f(err)
+	}
+}
+
+// processWithProgress is processRecovering sending SMFIR_PROGRESS every
+// autoProgressInterval until the command is processed, for commands the MTA waits for
+func (m *milterSession) processWithProgress(msg *Message) (Response, error) {
+	if m.autoProgressInterval <= 0 || msg.Code == 'O' || msg.Code == 'A' || msg.Code == 'D' || m.noReply(msg.Code) {
+		return m.processRecovering(msg)
+	}
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		ticker := time.NewTicker(m.autoProgressInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if m.WritePacket(&Message{'p', nil}) != nil {
+					return
+				}
+			case <-stop:
+				return
+			}
+		}
+	}()
+	// the reply must not be sent before the last progress report
+	defer func() {
+		close(stop)
+		<-done
+	}()
+	return m.processRecovering(msg)
+}
+
+// processRecovering is Process turning panics into panicResponse if recoverPerCommand
+// is set, the panic is passed to the error handlers. Panics while negotiating close the
+// session
+func (m *milterSession) processRecovering(msg *Message) (resp Response, err error) {
+	if !m.recoverPerCommand {
+		return m.Process(msg)
+	}
+	defer func() {
+		r := recover()
+		if r == nil {
+			return
+		}
+		logError(m.logger, "Panic during milter command: %v\n%s", r, debug.Stack())
+		for _, f := range m.errHandlers {
+			f(panicError(r))
+		}
+		switch msg.Code {
+		case 'O':
+			resp, err = nil, panicError(r)
+		case 'A', 'D':
+			// no reply expected
+			resp, err = nil, nil
+		default:
+			resp, err = m.panicResponse, nil
+			if resp == nil {
+				resp = RespTempFail
+			}
+		}
+	}()
+	return m.Process(msg)
+}
+
 // HandleMilterComands processes all milter commands in the same connection
 func (m *milterSession) HandleMilterCommands() {
 
 	defer m.sock.Close()
-	defer m.milter.EndSession()
 
-	m.milter.NewSession(m.logger)
+	// the milter session starts with the first command after negotiation, a
+	// connection that only negotiates and quits is a health check. sawSession is
+	// set by any other command and kept across SMFIC_QUIT_NC
+	var negotiated, started, sawSession bool
+	defer func() {
+		if started {
+			m.milter.EndSession()
+		}
+	}()
 
+	// on panic tell the MTA before the connection is closed, the panic is passed on
+	// to the server so that it gets reported
+	var msg *Message
+	defer func() {
+		if r := recover(); r != nil {
+			logError(m.logger, "Panic during milter command: %v\n%s", r, debug.Stack())
+			if msg != nil && msg.Code != 'A' && msg.Code != 'D' {
+				resp := m.panicResponse
+				if resp == nil {
+					resp = RespTempFail
+				}
+				m.WritePacket(resp.Response())
+			}
+			panic(r)
+		}
+	}()
+
+	// connections are idle until the first message and after each message
+	m.idle = true
 	for {
 		// ReadPacket
-		msg, err := m.ReadPacket()
+		var err error
+		msg, err = m.ReadPacket()
 		if err != nil {
+			if netErr, ok := err.(net.Error); ok && netErr.Timeout() && m.idle && m.idleTimeout > 0 {
+				logInfo(m.logger, "Closing connection idle for %v", m.idleTimeout)
+				return
+			}
 			if err != io.EOF {
-				m.logger.Printf("Error reading milter command: %v", err)
+				logError(m.logger, "Error reading milter command: %v", err)
 			}
+			m.report(err)
 			return
 		}
 
+		if msg.Code != 'O' && msg.Code != 'Q' {
+			sawSession = true
+		}
+		switch {
+		case msg.Code == 'O':
+			negotiated = true
+		case msg.Code == 'Q':
+			if negotiated && !sawSession && m.onHealthCheck != nil {
+				m.onHealthCheck()
+			}
+		case msg.Code == 'K':
+			// the next command starts a new milter session
+			if started {
+				started = false
+				m.milter.EndSession()
+			}
+			m.earlierMessages += m.messages
+			m.messages = 0
+			if m.newSessionID != nil {
+				m.sessionID = m.newSessionID()
+			}
+		case !started:
+			started = true
+			m.milter.NewSession(m.logger)
+		}
+
 		// process command
-		resp, err := m.Process(msg)
+		resp, err := m.processWithProgress(msg)
+		// callback errors can be turned into a response instead of closing the session,
+		// not for commands the MTA reads no reply for. Malformed commands always close it
+		if _, malformed := err.(*ProtocolError); err != nil && err != ErrCloseSession && !malformed &&
+			!strings.ContainsRune("OADK", rune(msg.Code)) && m.errorResponse != nil {
+			if mapped := m.errorResponse(m.stage, err); mapped != nil {
+				logError(m.logger, "Error performing milter command: %v", err)
+				resp, err = mapped, nil
+			}
+		}
 		if err != nil {
 			if err != ErrCloseSession {
 				// log error condition
-				m.logger.Printf("Error performing milter command: %v", err)
+				logError(m.logger, "Error performing milter command: %v", err)
 			}
+			m.report(err)
 			return
 		}
 
+		m.idle = msg.Code == 'E' || msg.Code == 'A' || msg.Code == 'K' || (m.idle && msg.Code == 'O')
+		closeAfter := closing(resp)
+		// the MTA does not wait for replies it negotiated away
+		if resp != nil && m.noReply(msg.Code) {
+			if resp.Response().Code != continue_ {
+				logDebug(m.logger, "Dropping %c response to %c command negotiated without reply", resp.Response().Code, msg.Code)
+			}
+			resp = nil
+		}
+
 		// ignore empty responses
+		if resp != nil && m.delay > 0 {
+			delay := m.delay
+			m.delay = 0
+			if err = m.sleep(delay); err != nil {
+				if err != io.EOF {
+					logError(m.logger, "Error delaying reply: %v", err)
+				}
+				return
+			}
+		}
 		if resp != nil {
 			// send back response message
 			if err = m.WritePacket(resp.Response()); err != nil {
-				m.logger.Printf("Error writing packet: %v", err)
+				logError(m.logger, "Error writing packet: %v", err)
+				m.report(err)
 				return
 			}
 		}
+		if closeAfter {
+			return
+		}
 	}
 }
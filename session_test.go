@@ -0,0 +1,1422 @@
+package milter
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/textproto"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// bufferSock is an in-memory socket, reads are served from in and writes go to out
+type bufferSock struct {
+	in, out bytes.Buffer
+	closed  bool
+}
+
+func (b *bufferSock) Read(p []byte) (int, error)  { return b.in.Read(p) }
+func (b *bufferSock) Write(p []byte) (int, error) { return b.out.Write(p) }
+func (b *bufferSock) Close() error                { b.closed = true; return nil }
+
+// send queues a command packet for the session to read
+func (b *bufferSock) send(code byte, data []byte) {
+	binary.Write(&b.in, binary.BigEndian, uint32(len(data)+1))
+	b.in.WriteByte(code)
+	b.in.Write(data)
+}
+
+// replies decodes all packets written by the session so far
+func (b *bufferSock) replies(t *testing.T) []*Message {
+	t.Helper()
+	reader := &milterSession{sock: &bufferSock{in: b.out}}
+	var messages []*Message
+	for {
+		msg, err := reader.ReadPacket()
+		if err == io.EOF {
+			return messages
+		}
+		if err != nil {
+			t.Fatalf("Error decoding reply: %v", err)
+		}
+		messages = append(messages, msg)
+	}
+}
+
+// codes returns the reply codes written by the session as a string
+func (b *bufferSock) codes(t *testing.T) string {
+	t.Helper()
+	var codes []byte
+	for _, msg := range b.replies(t) {
+		codes = append(codes, msg.Code)
+	}
+	return string(codes)
+}
+
+// testLogger records log lines
+type testLogger struct {
+	sync.Mutex
+	lines []string
+}
+
+func (l *testLogger) Printf(format string, v ...interface{}) {
+	l.Lock()
+	defer l.Unlock()
+	l.lines = append(l.lines, fmt.Sprintf(format, v...))
+}
+
+// contains reports whether any log line contains s
+func (l *testLogger) contains(s string) bool {
+	l.Lock()
+	defer l.Unlock()
+	for _, line := range l.lines {
+		if strings.Contains(line, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// hookMilter is a Milter continuing at every stage unless a hook is set
+type hookMilter struct {
+	connect   func(host string, family string, port uint16, addr net.IP, m *Modifier) (Response, error)
+	helo      func(name string, m *Modifier) (Response, error)
+	mailFrom  func(from string, args []string, m *Modifier) (Response, error)
+	rcptTo    func(rcptTo string, args []string, m *Modifier) (Response, error)
+	header    func(name string, value string, m *Modifier) (Response, error)
+	headers   func(h textproto.MIMEHeader, m *Modifier) (Response, error)
+	bodyChunk func(chunk []byte, m *Modifier) (Response, error)
+	body      func(m *Modifier) (Response, error)
+
+	// names of the called methods
+	calls []string
+}
+
+func (h *hookMilter) NewSession(Logger) { h.calls = append(h.calls, "NewSession") }
+func (h *hookMilter) NewMessage()       { h.calls = append(h.calls, "NewMessage") }
+func (h *hookMilter) Reset()            { h.calls = append(h.calls, "Reset") }
+func (h *hookMilter) EndSession()       { h.calls = append(h.calls, "EndSession") }
+
+func (h *hookMilter) Connect(host string, family string, port uint16, addr net.IP, m *Modifier) (Response, error) {
+	h.calls = append(h.calls, "Connect")
+	if h.connect != nil {
+		return h.connect(host, family, port, addr, m)
+	}
+	return RespContinue, nil
+}
+
+func (h *hookMilter) Helo(name string, m *Modifier) (Response, error) {
+	h.calls = append(h.calls, "Helo")
+	if h.helo != nil {
+		return h.helo(name, m)
+	}
+	return RespContinue, nil
+}
+
+func (h *hookMilter) MailFrom(from string, args []string, m *Modifier) (Response, error) {
+	h.calls = append(h.calls, "MailFrom")
+	if h.mailFrom != nil {
+		return h.mailFrom(from, args, m)
+	}
+	return RespContinue, nil
+}
+
+func (h *hookMilter) RcptTo(rcptTo string, args []string, m *Modifier) (Response, error) {
+	h.calls = append(h.calls, "RcptTo")
+	if h.rcptTo != nil {
+		return h.rcptTo(rcptTo, args, m)
+	}
+	return RespContinue, nil
+}
+
+func (h *hookMilter) Header(name string, value string, m *Modifier) (Response, error) {
+	h.calls = append(h.calls, "Header")
+	if h.header != nil {
+		return h.header(name, value, m)
+	}
+	return RespContinue, nil
+}
+
+func (h *hookMilter) Headers(hdr textproto.MIMEHeader, m *Modifier) (Response, error) {
+	h.calls = append(h.calls, "Headers")
+	if h.headers != nil {
+		return h.headers(hdr, m)
+	}
+	return RespContinue, nil
+}
+
+func (h *hookMilter) BodyChunk(chunk []byte, m *Modifier) (Response, error) {
+	h.calls = append(h.calls, "BodyChunk")
+	if h.bodyChunk != nil {
+		return h.bodyChunk(chunk, m)
+	}
+	return RespContinue, nil
+}
+
+func (h *hookMilter) Body(m *Modifier) (Response, error) {
+	h.calls = append(h.calls, "Body")
+	if h.body != nil {
+		return h.body(m)
+	}
+	return RespAccept, nil
+}
+
+// newTestSession creates a session for milter reading from and writing to an in-memory socket
+func newTestSession(milter Milter, actions OptAction, protocol OptProtocol) (*milterSession, *bufferSock, *testLogger) {
+	sock := &bufferSock{}
+	logger := &testLogger{}
+	session := &milterSession{
+		actions:    actions,
+		protocol:   protocol,
+		mtaActions: actions,
+		sock:       sock,
+		milter:     milter,
+		logger:     logger,
+	}
+	return session, sock, logger
+}
+
+// cstrings encodes values as consecutive NUL terminated strings
+func cstrings(values ...string) []byte {
+	var data []byte
+	for _, v := range values {
+		data = append(data, v...)
+		data = append(data, 0)
+	}
+	return data
+}
+
+// optneg encodes a SMFIC_OPTNEG offer
+func optneg(version uint32, actions OptAction, protocol OptProtocol) []byte {
+	data := make([]byte, 12)
+	binary.BigEndian.PutUint32(data, version)
+	binary.BigEndian.PutUint32(data[4:], uint32(actions))
+	binary.BigEndian.PutUint32(data[8:], uint32(protocol))
+	return data
+}
+
+// connectData encodes a SMFIC_CONNECT packet, unknown connections have
+// neither port nor address
+func connectData(host string, family byte, port uint16, addr string) []byte {
+	data := append(cstrings(host), family)
+	if family == 'U' {
+		return data
+	}
+	data = append(data, byte(port>>8), byte(port))
+	return append(data, cstrings(addr)...)
+}
+
+func TestNegotiateNoActions(t *testing.T) {
+	errNoActions := errors.New("filter needs to change headers")
+
+	var wanted OptAction
+	session, sock, logger := newTestSession(&hookMilter{}, OptAddHeader|OptChangeHeader, 0)
+	session.onNoActions = func(w OptAction) error {
+		wanted = w
+		return errNoActions
+	}
+	sock.send('O', optneg(6, 0, OptProtocol(0x1fffff)))
+	sock.send('C', cstrings("localhost", "4"))
+	session.HandleMilterCommands()
+
+	if wanted != OptAddHeader|OptChangeHeader {
+		t.Errorf("OnNoActions got %#x, expected %#x", wanted, OptAddHeader|OptChangeHeader)
+	}
+	if codes := sock.codes(t); codes != "" {
+		t.Errorf("Expected connection to be closed without reply, got %q", codes)
+	}
+	if !logger.contains(errNoActions.Error()) {
+		t.Errorf("Expected rejection reason to be logged, got %q", logger.lines)
+	}
+
+	// without a handler the filter proceeds as before
+	session, sock, _ = newTestSession(&hookMilter{}, OptAddHeader, 0)
+	sock.send('O', optneg(6, 0, 0))
+	session.HandleMilterCommands()
+	if codes := sock.codes(t); codes != "O" {
+		t.Errorf("Expected negotiation reply, got %q", codes)
+	}
+}
+
+func TestNegotiateErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		data []byte
+		err  error
+	}{
+		{"legacy", nil, nil},
+		{"valid", optneg(6, OptAllActions, 0), nil},
+		{"truncated", optneg(6, OptAllActions, 0)[:8], ErrNegotiationMalformed},
+		{"single byte", []byte{2}, ErrNegotiationMalformed},
+		{"version zero", optneg(0, OptAllActions, 0), ErrNegotiationVersion},
+		{"version one", optneg(1, OptAllActions, 0), ErrNegotiationVersion},
+	}
+	for _, test := range tests {
+		session, _, _ := newTestSession(&hookMilter{}, OptAddHeader, 0)
+		_, err := session.Process(&Message{'O', test.data})
+		if err != test.err {
+			t.Errorf("%s: got error %v, expected %v", test.name, err, test.err)
+		}
+	}
+}
+
+func TestHealthCheck(t *testing.T) {
+	milter := &hookMilter{}
+	checks := 0
+	session, sock, _ := newTestSession(milter, OptAddHeader, 0)
+	session.onHealthCheck = func() { checks++ }
+	sock.send('O', optneg(6, OptAllActions, 0))
+	sock.send('Q', nil)
+	session.HandleMilterCommands()
+
+	if checks != 1 {
+		t.Errorf("Expected one health check, got %d", checks)
+	}
+	if len(milter.calls) != 0 {
+		t.Errorf("Expected no milter calls, got %v", milter.calls)
+	}
+	if codes := sock.codes(t); codes != "O" {
+		t.Errorf("Expected negotiation reply only, got %q", codes)
+	}
+	if !sock.closed {
+		t.Error("Expected connection to be closed")
+	}
+
+	// a regular session is not a health check
+	milter = &hookMilter{}
+	session, sock, _ = newTestSession(milter, OptAddHeader, 0)
+	session.onHealthCheck = func() { checks++ }
+	sock.send('O', optneg(6, OptAllActions, 0))
+	sock.send('H', cstrings("mx.example.com"))
+	sock.send('Q', nil)
+	session.HandleMilterCommands()
+
+	if checks != 1 {
+		t.Errorf("Expected no further health checks, got %d", checks)
+	}
+	expected := []string{"NewSession", "Helo", "EndSession"}
+	if !reflect.DeepEqual(milter.calls, expected) {
+		t.Errorf("Got calls %v, expected %v", milter.calls, expected)
+	}
+
+	// nor is one ended with SMFIC_QUIT_NC before quitting
+	session, sock, _ = newTestSession(&hookMilter{}, OptAddHeader, 0)
+	session.onHealthCheck = func() { checks++ }
+	sock.send('O', optneg(6, OptAllActions, 0))
+	sock.send('C', connectData("mx.example.com", '4', 25, "192.0.2.1"))
+	sock.send('M', cstrings("<from@example.com>"))
+	sock.send('E', nil)
+	sock.send('K', nil)
+	sock.send('Q', nil)
+	session.HandleMilterCommands()
+
+	if checks != 1 {
+		t.Errorf("Expected no health check after QUIT_NC, got %d", checks-1)
+	}
+}
+
+func TestStage(t *testing.T) {
+	stages := map[string]Stage{}
+	record := func(name string, m *Modifier) (Response, error) {
+		stages[name] = m.Stage()
+		return RespContinue, nil
+	}
+	milter := &hookMilter{
+		connect: func(host string, family string, port uint16, addr net.IP, m *Modifier) (Response, error) {
+			return record("Connect", m)
+		},
+		helo:     func(name string, m *Modifier) (Response, error) { return record("Helo", m) },
+		mailFrom: func(from string, args []string, m *Modifier) (Response, error) { return record("MailFrom", m) },
+		rcptTo:   func(rcptTo string, args []string, m *Modifier) (Response, error) { return record("RcptTo", m) },
+		header: func(name string, value string, m *Modifier) (Response, error) {
+			return record("Header", m)
+		},
+		headers: func(h textproto.MIMEHeader, m *Modifier) (Response, error) {
+			return record("Headers", m)
+		},
+		bodyChunk: func(chunk []byte, m *Modifier) (Response, error) { return record("BodyChunk", m) },
+		body:      func(m *Modifier) (Response, error) { return record("Body", m) },
+	}
+	session, sock, _ := newTestSession(milter, 0, 0)
+	sock.send('O', optneg(6, OptAllActions, 0))
+	sock.send('C', connectData("localhost", '4', 25, "127.0.0.1"))
+	sock.send('H', cstrings("mx.example.com"))
+	sock.send('M', cstrings("<from@example.com>"))
+	sock.send('R', cstrings("<to@example.com>"))
+	sock.send('T', nil)
+	sock.send('L', cstrings("Subject", "test"))
+	sock.send('N', nil)
+	sock.send('B', []byte("body"))
+	sock.send('E', nil)
+	session.HandleMilterCommands()
+
+	expected := map[string]Stage{
+		"Connect":   StageConnect,
+		"Helo":      StageHelo,
+		"MailFrom":  StageMailFrom,
+		"RcptTo":    StageRcptTo,
+		"Header":    StageHeader,
+		"Headers":   StageEOH,
+		"BodyChunk": StageBody,
+		"Body":      StageEOM,
+	}
+	if !reflect.DeepEqual(stages, expected) {
+		t.Errorf("Got stages %v, expected %v", stages, expected)
+	}
+}
+
+func TestEnvelopeArgs(t *testing.T) {
+	var from, rcpt string
+	var fromArgs, rcptArgs [][]string
+	milter := &hookMilter{
+		mailFrom: func(f string, args []string, m *Modifier) (Response, error) {
+			from, fromArgs = f, append(fromArgs, args)
+			return RespContinue, nil
+		},
+		rcptTo: func(r string, args []string, m *Modifier) (Response, error) {
+			rcpt, rcptArgs = r, append(rcptArgs, args)
+			return RespContinue, nil
+		},
+	}
+	session, sock, _ := newTestSession(milter, 0, 0)
+	sock.send('M', cstrings("<from@example.com>", "SIZE=10240", "BODY=8BITMIME"))
+	sock.send('R', cstrings("<to@example.com>", "NOTIFY=NEVER"))
+	sock.send('R', append(cstrings("<other@example.com>", ""), 0))
+	session.HandleMilterCommands()
+
+	if from != "from@example.com" {
+		t.Errorf("Got sender %q", from)
+	}
+	if rcpt != "other@example.com" {
+		t.Errorf("Got recipient %q", rcpt)
+	}
+	if expected := [][]string{{"SIZE=10240", "BODY=8BITMIME"}}; !reflect.DeepEqual(fromArgs, expected) {
+		t.Errorf("Got MAIL arguments %q, expected %q", fromArgs, expected)
+	}
+	// padding is not passed on as arguments
+	if expected := [][]string{{"NOTIFY=NEVER"}, nil}; !reflect.DeepEqual(rcptArgs, expected) {
+		t.Errorf("Got RCPT arguments %q, expected %q", rcptArgs, expected)
+	}
+}
+
+func TestErrorResponse(t *testing.T) {
+	errScan := errors.New("virus scanner unavailable")
+	var stage Stage
+	milter := &hookMilter{
+		body: func(m *Modifier) (Response, error) {
+			return nil, errScan
+		},
+	}
+	session, sock, logger := newTestSession(milter, 0, 0)
+	session.errorResponse = func(s Stage, err error) Response {
+		stage = s
+		if s == StageEOM {
+			return RespTempFail
+		}
+		return nil
+	}
+	sock.send('E', nil)
+	sock.send('M', cstrings("<from@example.com>"))
+	session.HandleMilterCommands()
+
+	if stage != StageEOM {
+		t.Errorf("Expected error to be mapped for stage eom, got %v", stage)
+	}
+	if codes := sock.codes(t); codes != "tc" {
+		t.Errorf("Expected tempfail and the session to continue, got %q", codes)
+	}
+	if !logger.contains(errScan.Error()) {
+		t.Errorf("Expected error to be logged, got %q", logger.lines)
+	}
+}
+
+func TestErrorResponseNoReply(t *testing.T) {
+	var reported []error
+	session, sock, _ := newTestSession(&hookMilter{}, 0, 0)
+	session.errorResponse = func(s Stage, err error) Response {
+		return RespTempFail
+	}
+	session.errHandlers = []func(error){func(err error) { reported = append(reported, err) }}
+	sock.send('H', cstrings("mx.example.com"))
+	sock.send('D', nil)
+	sock.send('H', cstrings("mx.example.com"))
+	session.HandleMilterCommands()
+
+	// the MTA reads no reply for macros, the session ends instead
+	if codes := sock.codes(t); codes != "c" {
+		t.Errorf("Expected no reply to the macros, got %q", codes)
+	}
+	if len(reported) != 1 {
+		t.Errorf("Expected the error to be reported, got %v", reported)
+	}
+}
+
+func TestErrorResponseProtocolError(t *testing.T) {
+	var mapped bool
+	session, sock, _ := newTestSession(&hookMilter{}, 0, 0)
+	session.errorResponse = func(s Stage, err error) Response {
+		mapped = true
+		return RespTempFail
+	}
+	sock.send('L', []byte("Subject"))
+	sock.send('H', cstrings("mx.example.com"))
+	session.HandleMilterCommands()
+
+	if mapped {
+		t.Error("Expected ProtocolError not to be mapped")
+	}
+	if codes := sock.codes(t); codes != "" || !sock.closed {
+		t.Errorf("Expected session to be closed without reply, got %q", codes)
+	}
+}
+
+func TestDefaultDisposition(t *testing.T) {
+	tests := []struct {
+		disposition Response
+		codes       string
+	}{
+		{nil, "a"},
+		{RespTempFail, "t"},
+	}
+	for _, test := range tests {
+		milter := &hookMilter{
+			body: func(m *Modifier) (Response, error) {
+				return RespContinue, nil
+			},
+		}
+		session, sock, logger := newTestSession(milter, 0, 0)
+		session.disposition = test.disposition
+		sock.send('E', nil)
+		session.HandleMilterCommands()
+
+		if codes := sock.codes(t); codes != test.codes {
+			t.Errorf("Expected %q at end of message, got %q", test.codes, codes)
+		}
+		if len(logger.lines) != 1 {
+			t.Errorf("Expected a warning, got %q", logger.lines)
+		}
+	}
+}
+
+// unknownMilter rejects unknown SMTP commands
+type unknownMilter struct {
+	hookMilter
+	commands []string
+}
+
+func (u *unknownMilter) Unknown(cmd string, m *Modifier) (Response, error) {
+	u.commands = append(u.commands, cmd)
+	return RespReject, nil
+}
+
+func TestUnknownCommand(t *testing.T) {
+	milter := &unknownMilter{}
+	session, sock, _ := newTestSession(milter, 0, 0)
+	sock.send('U', cstrings("XCLIENT ADDR=192.0.2.1"))
+	session.HandleMilterCommands()
+
+	if !reflect.DeepEqual(milter.commands, []string{"XCLIENT ADDR=192.0.2.1"}) {
+		t.Errorf("Got unknown commands %q", milter.commands)
+	}
+	if codes := sock.codes(t); codes != "r" {
+		t.Errorf("Expected reject, got %q", codes)
+	}
+
+	// milters without Unknown continue
+	session, sock, _ = newTestSession(&hookMilter{}, 0, 0)
+	sock.send('U', cstrings("AUTH PLAIN"))
+	session.HandleMilterCommands()
+	if codes := sock.codes(t); codes != "c" {
+		t.Errorf("Expected continue, got %q", codes)
+	}
+}
+
+// dataMilter rejects messages at DATA based on the queue ID macro
+type dataMilter struct {
+	hookMilter
+	queueID string
+}
+
+func (d *dataMilter) Data(m *Modifier) (Response, error) {
+	d.queueID = m.Macros["i"]
+	return RespReject, nil
+}
+
+func TestDataCommand(t *testing.T) {
+	milter := &dataMilter{}
+	session, sock, _ := newTestSession(milter, 0, 0)
+	sock.send('D', append([]byte{'T'}, cstrings("i", "4ABC123")...))
+	sock.send('T', nil)
+	session.HandleMilterCommands()
+
+	if milter.queueID != "4ABC123" {
+		t.Errorf("Expected macros defined before DATA, got queue ID %q", milter.queueID)
+	}
+	if codes := sock.codes(t); codes != "r" {
+		t.Errorf("Expected reject, got %q", codes)
+	}
+}
+
+func TestNoReplyBody(t *testing.T) {
+	tests := []struct {
+		name  string
+		offer OptProtocol
+		codes string
+	}{
+		{"negotiated", OptNrBody | OptNrEOH, "Oa"},
+		{"not offered", 0, "Occca"},
+	}
+	for _, test := range tests {
+		session, sock, _ := newTestSession(&hookMilter{}, 0, OptNrBody|OptNrEOH)
+		sock.send('O', optneg(6, OptAllActions, test.offer))
+		sock.send('N', nil)
+		sock.send('B', []byte("first"))
+		sock.send('B', []byte("second"))
+		sock.send('E', nil)
+		session.HandleMilterCommands()
+
+		if codes := sock.codes(t); codes != test.codes {
+			t.Errorf("%s: expected replies %q, got %q", test.name, test.codes, codes)
+		}
+	}
+}
+
+func TestNegotiateRequired(t *testing.T) {
+	tests := []struct {
+		name     string
+		offer    []byte
+		codes    string
+		rejected bool
+	}{
+		{"offered", optneg(6, OptAllActions, OptSkip), "O", false},
+		{"missing action", optneg(6, OptAddHeader, OptSkip), "", true},
+		{"missing protocol", optneg(6, OptAllActions, 0), "", true},
+		{"legacy MTA", nil, "O", false},
+	}
+	for _, test := range tests {
+		session, sock, logger := newTestSession(&hookMilter{}, OptAddHeader|OptChangeBody, 0)
+		session.requiredActions = OptChangeBody
+		session.requiredProtocol = OptSkip
+		sock.send('O', test.offer)
+		session.HandleMilterCommands()
+
+		if codes := sock.codes(t); codes != test.codes {
+			t.Errorf("%s: expected replies %q, got %q", test.name, test.codes, codes)
+		}
+		if logger.contains(ErrNegotiationRequired.Error()) != test.rejected {
+			t.Errorf("%s: got log %q", test.name, logger.lines)
+		}
+	}
+}
+
+func TestSkipBody(t *testing.T) {
+	tests := []struct {
+		name   string
+		offer  OptProtocol
+		codes  string
+		chunks int
+	}{
+		{"negotiated", OptSkip, "Osca", 1},
+		{"not negotiated", 0, "Occca", 3},
+	}
+	for _, test := range tests {
+		chunks, bodies := 0, 0
+		milter := &hookMilter{
+			bodyChunk: func(chunk []byte, m *Modifier) (Response, error) {
+				chunks++
+				return RespSkip, nil
+			},
+			body: func(m *Modifier) (Response, error) {
+				bodies++
+				return RespAccept, nil
+			},
+		}
+		session, sock, _ := newTestSession(milter, 0, OptSkip)
+		sock.send('O', optneg(6, OptAllActions, test.offer))
+		sock.send('B', []byte("first"))
+		if test.offer == 0 {
+			sock.send('B', []byte("second"))
+		}
+		// a chunk already in flight when the MTA got the skip
+		sock.send('B', []byte("third"))
+		sock.send('E', nil)
+		session.HandleMilterCommands()
+
+		if codes := sock.codes(t); codes != test.codes {
+			t.Errorf("%s: expected replies %q, got %q", test.name, test.codes, codes)
+		}
+		if chunks != test.chunks || bodies != 1 {
+			t.Errorf("%s: got %d chunks and %d end of body calls", test.name, chunks, bodies)
+		}
+	}
+}
+
+// negotiateMilter asks for all actions the MTA offers, negotiate is called if set
+type negotiateMilter struct {
+	hookMilter
+	offered   OptAction
+	negotiate func(m *Modifier)
+}
+
+func (n *negotiateMilter) Negotiate(mtaActions OptAction, mtaProtocol OptProtocol, m *Modifier) (OptAction, OptProtocol) {
+	n.offered = mtaActions
+	if n.negotiate != nil {
+		n.negotiate(m)
+	}
+	return OptAllActions, OptNoHelo | OptSkip
+}
+
+func TestNegotiateHook(t *testing.T) {
+	milter := &negotiateMilter{}
+	session, sock, _ := newTestSession(milter, OptAddHeader, 0)
+	sock.send('O', optneg(6, OptAddHeader|OptChangeBody, OptNoHelo|OptNoBody))
+	session.HandleMilterCommands()
+
+	if milter.offered != OptAddHeader|OptChangeBody {
+		t.Errorf("Negotiate got actions %#x", milter.offered)
+	}
+	replies := sock.replies(t)
+	if len(replies) != 1 || !bytes.Equal(replies[0].Data, optneg(6, OptAddHeader|OptChangeBody, OptNoHelo)) {
+		t.Errorf("Expected options limited to the offer, got %v", replies)
+	}
+}
+
+func TestReportMalformedPacket(t *testing.T) {
+	for _, expected := range []error{ErrPacketTooLarge, ErrPacketEmpty} {
+		var reported []error
+		session, sock, _ := newTestSession(&hookMilter{}, 0, 0)
+		session.errHandlers = []func(error){func(err error) { reported = append(reported, err) }}
+		sock.send('H', cstrings("mx.example.com"))
+		if expected == ErrPacketTooLarge {
+			binary.Write(&sock.in, binary.BigEndian, uint32(0xFFFFFFFF))
+		} else {
+			binary.Write(&sock.in, binary.BigEndian, uint32(0))
+		}
+		session.HandleMilterCommands()
+
+		if len(reported) != 1 || reported[0] != expected {
+			t.Errorf("Expected %v to be reported, got %v", expected, reported)
+		}
+		if codes := sock.codes(t); codes != "c" || !sock.closed {
+			t.Errorf("Expected session to be closed after the packet, got %q", codes)
+		}
+	}
+}
+
+func TestReadPacketMaxDataSize(t *testing.T) {
+	session, sock, _ := newTestSession(&hookMilter{}, 0, 0)
+	binary.Write(&sock.in, binary.BigEndian, uint32(0xFFFFFFFF))
+	if _, err := session.ReadPacket(); err != ErrPacketTooLarge {
+		t.Errorf("Expected ErrPacketTooLarge, got %v", err)
+	}
+
+	// the limit applies to the data following the code
+	session, sock, _ = newTestSession(&hookMilter{}, 0, 0)
+	session.maxDataSize = 4
+	sock.send('B', []byte("1234"))
+	sock.send('B', []byte("12345"))
+	if _, err := session.ReadPacket(); err != nil {
+		t.Errorf("Expected packet within limit, got %v", err)
+	}
+	if _, err := session.ReadPacket(); err != ErrPacketTooLarge {
+		t.Errorf("Expected ErrPacketTooLarge, got %v", err)
+	}
+
+	// negotiated sizes raise the default
+	session, sock, _ = newTestSession(&hookMilter{}, 0, OptMDS1M)
+	session.mtaProtocol = OptMDS1M
+	sock.send('B', make([]byte, 512*1024))
+	if _, err := session.ReadPacket(); err != nil {
+		t.Errorf("Expected 1MB limit, got %v", err)
+	}
+}
+
+func TestConnectIPv6(t *testing.T) {
+	for address, expected := range map[string]string{
+		"IPv6:2001:db8::1":         "2001:db8::1",
+		"ipv6:fe80::1":             "fe80::1",
+		"IPV6:::1":                 "::1",
+		"2001:db8:0:0:0:0:0:1":     "2001:db8::1",
+		"fe80::200:5aee:feaa:20a2": "fe80::200:5aee:feaa:20a2",
+		"192.0.2.1":                "192.0.2.1",
+	} {
+		var addr net.IP
+		milter := &hookMilter{
+			connect: func(host string, family string, port uint16, a net.IP, m *Modifier) (Response, error) {
+				addr = a
+				return RespContinue, nil
+			},
+		}
+		session, sock, _ := newTestSession(milter, 0, 0)
+		sock.send('C', connectData("mx.example.com", '6', 25, address))
+		session.HandleMilterCommands()
+
+		if !addr.Equal(net.ParseIP(expected)) {
+			t.Errorf("Address %q parsed as %v", address, addr)
+		}
+	}
+}
+
+func TestEndOfMessageMacros(t *testing.T) {
+	var queueID, mailer, client string
+	milter := &hookMilter{
+		body: func(m *Modifier) (Response, error) {
+			queueID, _ = m.Macro("i")
+			mailer, _ = m.Macro("mail_mailer")
+			client, _ = m.Macro("client_addr")
+			return RespAccept, nil
+		},
+	}
+	session, sock, _ := newTestSession(milter, 0, 0)
+	sock.send('D', append([]byte{'C'}, cstrings("{client_addr}", "192.0.2.1")...))
+	sock.send('C', connectData("mx.example.com", '4', 25, "192.0.2.1"))
+	sock.send('D', append([]byte{'M'}, cstrings("{mail_mailer}", "esmtp", "i", "")...))
+	sock.send('M', cstrings("<from@example.com>"))
+	sock.send('D', append([]byte{'E'}, cstrings("i", "4AB1C2D3E4")...))
+	sock.send('E', nil)
+	session.HandleMilterCommands()
+
+	if queueID != "4AB1C2D3E4" {
+		t.Errorf("Expected queue id from end of message macros, got %q", queueID)
+	}
+	if mailer != "esmtp" || client != "192.0.2.1" {
+		t.Errorf("Expected earlier macros to be kept, got %q and %q", mailer, client)
+	}
+}
+
+func TestPreserveAddressCase(t *testing.T) {
+	for _, preserve := range []bool{false, true} {
+		var from, rcpt string
+		milter := &hookMilter{
+			mailFrom: func(f string, args []string, m *Modifier) (Response, error) {
+				from = f
+				return RespContinue, nil
+			},
+			rcptTo: func(r string, args []string, m *Modifier) (Response, error) {
+				rcpt = r
+				return RespContinue, nil
+			},
+		}
+		session, sock, _ := newTestSession(milter, 0, 0)
+		session.preserveAddressCase = preserve
+		sock.send('M', cstrings("<John.Doe@Example.com>"))
+		sock.send('R', cstrings("<Jane.Doe@Example.org>"))
+		session.HandleMilterCommands()
+
+		expectedFrom, expectedRcpt := "john.doe@example.com", "jane.doe@example.org"
+		if preserve {
+			expectedFrom, expectedRcpt = "John.Doe@Example.com", "Jane.Doe@Example.org"
+		}
+		if from != expectedFrom || rcpt != expectedRcpt {
+			t.Errorf("Preserve %v: got sender %q and recipient %q", preserve, from, rcpt)
+		}
+	}
+}
+
+func TestHeaderPadding(t *testing.T) {
+	var headers []string
+	milter := &hookMilter{
+		header: func(name string, value string, m *Modifier) (Response, error) {
+			headers = append(headers, name+": "+value)
+			return RespContinue, nil
+		},
+	}
+	session, sock, _ := newTestSession(milter, 0, 0)
+	// trailing NULs as sent by milterclient are no extra strings
+	sock.send('L', append(cstrings("Subject", "Hello"), 0))
+	sock.send('L', cstrings("X-Empty", ""))
+	session.HandleMilterCommands()
+
+	if expected := []string{"Subject: Hello", "X-Empty: "}; !reflect.DeepEqual(headers, expected) {
+		t.Errorf("Got headers %q, expected %q", headers, expected)
+	}
+	if codes := sock.codes(t); codes != "cc" {
+		t.Errorf("Got replies %q", codes)
+	}
+}
+
+func TestProtocolError(t *testing.T) {
+	tests := []struct {
+		name string
+		code byte
+		data []byte
+	}{
+		{"connect without family", 'C', cstrings("mx.example.com")},
+		{"connect without port", 'C', append(cstrings("mx.example.com"), '4', 0)},
+		{"header without value", 'L', []byte("Subject")},
+		{"header without name", 'L', cstrings("", "Hello")},
+		{"header with extra string", 'L', cstrings("Subject", "Hello", "extra")},
+	}
+	for _, test := range tests {
+		var reported []error
+		session, sock, _ := newTestSession(&hookMilter{}, 0, 0)
+		session.errHandlers = []func(error){func(err error) { reported = append(reported, err) }}
+		sock.send(test.code, test.data)
+		session.HandleMilterCommands()
+
+		if len(reported) != 1 {
+			t.Errorf("%s: expected one reported error, got %v", test.name, reported)
+			continue
+		}
+		if err, ok := reported[0].(*ProtocolError); !ok || err.Code != test.code {
+			t.Errorf("%s: expected ProtocolError for %c, got %v", test.name, test.code, reported[0])
+		}
+		if codes := sock.codes(t); codes != "" || !sock.closed {
+			t.Errorf("%s: expected session to be closed without reply, got %q", test.name, codes)
+		}
+	}
+}
+
+func TestEmptyHeaderValue(t *testing.T) {
+	var headers [][2]string
+	milter := &hookMilter{
+		header: func(name string, value string, m *Modifier) (Response, error) {
+			headers = append(headers, [2]string{name, value})
+			return RespContinue, nil
+		},
+	}
+	session, sock, _ := newTestSession(milter, 0, 0)
+	sock.send('L', cstrings("X-Empty", ""))
+	sock.send('L', append(cstrings("Subject", "Hello"), 0))
+	session.HandleMilterCommands()
+
+	if expected := [][2]string{{"X-Empty", ""}, {"Subject", "Hello"}}; !reflect.DeepEqual(headers, expected) {
+		t.Errorf("Got headers %q, expected %q", headers, expected)
+	}
+	if codes := sock.codes(t); codes != "cc" {
+		t.Errorf("Expected both headers to be continued, got %q", codes)
+	}
+}
+
+// abortMilter records the sender seen by Abort
+type abortMilter struct {
+	hookMilter
+	sender string
+}
+
+func (a *abortMilter) Abort(m *Modifier) {
+	a.calls = append(a.calls, "Abort")
+	a.sender = m.Sender()
+}
+
+func TestAbort(t *testing.T) {
+	milter := &abortMilter{}
+	session, sock, _ := newTestSession(milter, 0, 0)
+	sock.send('M', cstrings("<from@example.com>"))
+	sock.send('A', nil)
+	session.HandleMilterCommands()
+
+	if expected := []string{"NewSession", "NewMessage", "MailFrom", "Abort", "Reset", "EndSession"}; !reflect.DeepEqual(milter.calls, expected) {
+		t.Errorf("Got calls %v, expected %v", milter.calls, expected)
+	}
+	if milter.sender != "from@example.com" {
+		t.Errorf("Expected message state to be intact in Abort, got sender %q", milter.sender)
+	}
+	if session.sender != "" {
+		t.Errorf("Expected message state to be reset after Abort")
+	}
+}
+
+func TestConnectUnixSocket(t *testing.T) {
+	var family, path string
+	var addr net.IP
+	milter := &hookMilter{
+		connect: func(host string, f string, port uint16, a net.IP, m *Modifier) (Response, error) {
+			family, addr, path = f, a, m.SocketPath()
+			return RespContinue, nil
+		},
+	}
+	session, sock, _ := newTestSession(milter, 0, 0)
+	sock.send('C', connectData("localhost", 'L', 0, "/var/run/sendmail.sock"))
+	session.HandleMilterCommands()
+
+	if family != "unix" || addr != nil || path != "/var/run/sendmail.sock" {
+		t.Errorf("Got family %q, address %v and path %q", family, addr, path)
+	}
+
+	// unknown connections carry no address at all, trailing data is ignored
+	for _, data := range [][]byte{
+		connectData("localhost", 'U', 0, ""),
+		append(connectData("localhost", 'U', 0, ""), 0, 25, '1', 0),
+	} {
+		var port uint16 = 1
+		milter.connect = func(host string, f string, p uint16, a net.IP, m *Modifier) (Response, error) {
+			family, port, addr, path = f, p, a, m.SocketPath()
+			return RespContinue, nil
+		}
+		family, path = "", "none"
+		session, sock, _ = newTestSession(milter, 0, 0)
+		sock.send('C', data)
+		session.HandleMilterCommands()
+		if family != "unknown" || port != 0 || addr != nil || path != "" {
+			t.Errorf("%q: got family %q, port %d, address %v and path %q", data, family, port, addr, path)
+		}
+		if codes := sock.codes(t); codes != "c" {
+			t.Errorf("%q: got replies %q", data, codes)
+		}
+	}
+}
+
+// shortWriter accepts at most max bytes per write and fails after failAfter writes
+type shortWriter struct {
+	bufferSock
+	max, writes, failAfter int
+}
+
+func (s *shortWriter) Write(p []byte) (int, error) {
+	s.writes++
+	if s.failAfter > 0 && s.writes > s.failAfter {
+		return 0, io.ErrClosedPipe
+	}
+	if len(p) > s.max {
+		p = p[:s.max]
+	}
+	return s.out.Write(p)
+}
+
+func TestWritePacketShortWrites(t *testing.T) {
+	sock := &shortWriter{max: 3}
+	session := &milterSession{sock: sock}
+	for _, msg := range []*Message{{'h', cstrings("X-Test", "value")}, {'a', nil}} {
+		if err := session.WritePacket(msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if codes := sock.codes(t); codes != "ha" {
+		t.Errorf("Expected complete packets, got %q", codes)
+	}
+
+	// nothing is written after a partial frame
+	sock = &shortWriter{max: 3, failAfter: 2}
+	session = &milterSession{sock: sock}
+	if err := session.WritePacket(&Message{'h', cstrings("X-Test", "value")}); err != io.ErrClosedPipe {
+		t.Errorf("Expected write error, got %v", err)
+	}
+	if err := session.WritePacket(&Message{'a', nil}); err != io.ErrClosedPipe {
+		t.Errorf("Expected earlier write error, got %v", err)
+	}
+	if sock.out.Len() != 6 || sock.writes != 3 {
+		t.Errorf("Expected writes to stop, got %d bytes in %d writes", sock.out.Len(), sock.writes)
+	}
+}
+
+func TestCloseConnection(t *testing.T) {
+	milter := &hookMilter{
+		body: func(m *Modifier) (Response, error) { return RespCloseConnection, nil },
+	}
+	session, sock, _ := newTestSession(milter, 0, 0)
+	sock.send('M', cstrings("<from@example.com>"))
+	sock.send('E', nil)
+	sock.send('M', cstrings("<other@example.com>"))
+	session.HandleMilterCommands()
+
+	if codes := sock.codes(t); codes != "ca" {
+		t.Errorf("Expected accept before closing, got %q", codes)
+	}
+	if !sock.closed {
+		t.Error("Expected connection to be closed")
+	}
+	if expected := []string{"NewSession", "NewMessage", "MailFrom", "Body", "EndSession"}; !reflect.DeepEqual(milter.calls, expected) {
+		t.Errorf("Got calls %v, expected %v", milter.calls, expected)
+	}
+}
+
+func TestCloseConnectionContinue(t *testing.T) {
+	milter := &hookMilter{
+		body: func(m *Modifier) (Response, error) { return CloseConnection(RespContinue), nil },
+	}
+	session, sock, _ := newTestSession(milter, 0, 0)
+	session.disposition = RespTempFail
+	sock.send('M', cstrings("<from@example.com>"))
+	sock.send('E', nil)
+	sock.send('M', cstrings("<other@example.com>"))
+	session.HandleMilterCommands()
+
+	// the default disposition is sent and the connection closed after EOM
+	if codes := sock.codes(t); codes != "ct" {
+		t.Errorf("Expected default disposition before closing, got %q", codes)
+	}
+	if !sock.closed {
+		t.Error("Expected connection to be closed")
+	}
+}
+
+func TestRecipientRejected(t *testing.T) {
+	var rejectedByMTA []bool
+	milter := &hookMilter{
+		rcptTo: func(rcptTo string, args []string, m *Modifier) (Response, error) {
+			rejectedByMTA = append(rejectedByMTA, m.RecipientRejected())
+			return RespContinue, nil
+		},
+		body: func(m *Modifier) (Response, error) {
+			if r := m.Recipients(); !reflect.DeepEqual(r, []string{"to@example.com", "to@example.com"}) {
+				t.Errorf("Expected only accepted recipients, got %v", r)
+			}
+			return RespAccept, nil
+		},
+	}
+	session, sock, _ := newTestSession(milter, 0, OptRcptRej)
+	sock.send('O', optneg(6, OptAllActions, OptRcptRej))
+	sock.send('M', cstrings("<from@example.com>"))
+	sock.send('D', append([]byte{'R'}, cstrings("{rcpt_mailer}", "error")...))
+	sock.send('R', cstrings("<unknown@example.com>"))
+	sock.send('D', append([]byte{'R'}, cstrings("{rcpt_mailer}", "esmtp")...))
+	sock.send('R', cstrings("<to@example.com>"))
+	sock.send('D', append([]byte{'R'}, cstrings("{rcpt_mailer}", "error")...))
+	sock.send('R', cstrings("<unknown@example.com>"))
+	// the macro of the rejected recipient does not apply to the next one
+	sock.send('R', cstrings("<to@example.com>"))
+	sock.send('E', nil)
+	session.HandleMilterCommands()
+
+	if expected := []bool{true, false, true, false}; !reflect.DeepEqual(rejectedByMTA, expected) {
+		t.Errorf("Got rejected %v, expected %v", rejectedByMTA, expected)
+	}
+}
+
+func TestRecipientMacros(t *testing.T) {
+	got := map[string]map[string]string{}
+	milter := &hookMilter{
+		rcptTo: func(rcptTo string, args []string, m *Modifier) (Response, error) {
+			if rcptTo == "refused@example.com" {
+				return RespReject, nil
+			}
+			return RespContinue, nil
+		},
+		body: func(m *Modifier) (Response, error) {
+			for _, rcpt := range []string{"a@example.com", "b@example.com", "refused@example.com"} {
+				got[rcpt] = m.RecipientMacros(rcpt)
+			}
+			// the macros returned are a copy
+			m.RecipientMacros("a@example.com")["{rcpt_mailer}"] = "changed"
+			if macros := m.RecipientMacros("a@example.com"); macros["{rcpt_mailer}"] != "local" {
+				t.Errorf("Expected session macros to be unchanged, got %v", macros)
+			}
+			return RespAccept, nil
+		},
+	}
+	session, sock, _ := newTestSession(milter, 0, 0)
+	sock.send('M', cstrings("<from@example.com>"))
+	sock.send('D', append([]byte{'R'}, cstrings("{rcpt_addr}", "a@example.com", "{rcpt_mailer}", "local")...))
+	sock.send('R', cstrings("<a@example.com>"))
+	sock.send('D', append([]byte{'R'}, cstrings("{rcpt_addr}", "refused@example.com", "{rcpt_mailer}", "esmtp")...))
+	sock.send('R', cstrings("<refused@example.com>"))
+	sock.send('D', append([]byte{'R'}, cstrings("{rcpt_addr}", "b@example.com", "{rcpt_mailer}", "esmtp")...))
+	sock.send('R', cstrings("<b@example.com>"))
+	sock.send('E', nil)
+	session.HandleMilterCommands()
+
+	expected := map[string]map[string]string{
+		"a@example.com":       {"{rcpt_addr}": "a@example.com", "{rcpt_mailer}": "local"},
+		"b@example.com":       {"{rcpt_addr}": "b@example.com", "{rcpt_mailer}": "esmtp"},
+		"refused@example.com": nil,
+	}
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("Got recipient macros %v, expected %v", got, expected)
+	}
+}
+
+func TestMessageTimeout(t *testing.T) {
+	var rcpts []string
+	milter := &hookMilter{
+		rcptTo: func(rcptTo string, args []string, m *Modifier) (Response, error) {
+			rcpts = append(rcpts, rcptTo)
+			if rcptTo == "slow@example.com" {
+				time.Sleep(20 * time.Millisecond)
+			}
+			return RespContinue, nil
+		},
+	}
+	session, sock, logger := newTestSession(milter, 0, 0)
+	session.messageTimeout = 10 * time.Millisecond
+	sock.send('M', cstrings("<from@example.com>"))
+	sock.send('R', cstrings("<fast@example.com>"))
+	sock.send('R', cstrings("<slow@example.com>"))
+	sock.send('R', cstrings("<next@example.com>"))
+	sock.send('T', nil)
+	sock.send('A', nil)
+	sock.send('M', cstrings("<from@example.com>"))
+	sock.send('R', cstrings("<next@example.com>"))
+	session.HandleMilterCommands()
+
+	// the recipient after the slow one is tempfailed without RcptTo, the message
+	// with the recipient accepted before fails at DATA
+	if codes := sock.codes(t); codes != "cctttcc" {
+		t.Errorf("Got replies %q", codes)
+	}
+	if expected := []string{"fast@example.com", "slow@example.com", "next@example.com"}; !reflect.DeepEqual(rcpts, expected) {
+		t.Errorf("Got recipients %v, expected %v", rcpts, expected)
+	}
+	if !logger.contains("exceeded timeout") {
+		t.Errorf("Expected timeout to be logged, got %q", logger.lines)
+	}
+}
+
+// levelLogger records log lines prefixed with their level
+type levelLogger struct {
+	testLogger
+}
+
+func (l *levelLogger) Debugf(format string, v ...interface{}) { l.Printf("debug: "+format, v...) }
+func (l *levelLogger) Infof(format string, v ...interface{})  { l.Printf("info: "+format, v...) }
+func (l *levelLogger) Warnf(format string, v ...interface{})  { l.Printf("warn: "+format, v...) }
+func (l *levelLogger) Errorf(format string, v ...interface{}) { l.Printf("error: "+format, v...) }
+
+func TestLevelLogger(t *testing.T) {
+	logger := &levelLogger{}
+	session, sock, _ := newTestSession(&hookMilter{}, 0, 0)
+	session.logger = logger
+	sock.send('Z', nil)
+	session.HandleMilterCommands()
+	if !logger.contains("debug: Unrecognized command code: Z") {
+		t.Errorf("Expected unknown command to be logged at debug level, got %q", logger.lines)
+	}
+
+	// loggers without levels get every line through Printf
+	session, sock, plain := newTestSession(&hookMilter{}, 0, 0)
+	sock.send('Z', nil)
+	session.HandleMilterCommands()
+	if !plain.contains("Unrecognized command code: Z") {
+		t.Errorf("Expected unknown command to be logged, got %q", plain.lines)
+	}
+}
+
+func TestNegotiateVersion(t *testing.T) {
+	for _, test := range []struct {
+		offer    []byte
+		expected uint32
+	}{
+		{nil, 2},
+		{optneg(2, OptAllActions, 0), 2},
+		{optneg(6, OptAllActions, 0), 6},
+		{optneg(7, OptAllActions, 0), 6},
+	} {
+		var version uint32
+		milter := &hookMilter{
+			helo: func(name string, m *Modifier) (Response, error) {
+				version = m.ProtocolVersion()
+				return RespContinue, nil
+			},
+		}
+		session, sock, _ := newTestSession(milter, 0, 0)
+		sock.send('O', test.offer)
+		sock.send('H', cstrings("mx.example.com"))
+		session.HandleMilterCommands()
+
+		if version != test.expected {
+			t.Errorf("Offer %v: got version %d, expected %d", test.offer, version, test.expected)
+		}
+		if replies := sock.replies(t); binary.BigEndian.Uint32(replies[0].Data) != test.expected {
+			t.Errorf("Offer %v: replied with %v", test.offer, replies[0].Data)
+		}
+	}
+}
+
+func TestMessageLifecycle(t *testing.T) {
+	milter := &hookMilter{}
+	session, sock, _ := newTestSession(milter, 0, 0)
+	sock.send('O', optneg(6, OptAllActions, 0))
+	sock.send('C', connectData("localhost", '4', 25, "127.0.0.1"))
+	sock.send('M', cstrings("<first@example.com>"))
+	sock.send('A', nil)
+	sock.send('M', cstrings("<second@example.com>"))
+	sock.send('R', cstrings("<to@example.com>"))
+	sock.send('E', nil)
+	sock.send('Q', nil)
+	session.HandleMilterCommands()
+
+	expected := []string{
+		"NewSession", "Connect",
+		"NewMessage", "MailFrom", "Reset",
+		"NewMessage", "MailFrom", "RcptTo", "Body",
+		"EndSession",
+	}
+	if !reflect.DeepEqual(milter.calls, expected) {
+		t.Errorf("Got calls %v, expected %v", milter.calls, expected)
+	}
+}
+
+func TestUnfoldHeaders(t *testing.T) {
+	folded := "from mx.example.com\r\n\tby mail.example.org;\n  Tue, 13 Oct 2026 10:00:00 +0000"
+	for _, unfoldHeaders := range []bool{false, true} {
+		var value, raw string
+		milter := &hookMilter{
+			header: func(name string, v string, m *Modifier) (Response, error) {
+				value, raw = v, m.RawHeaderValue()
+				return RespContinue, nil
+			},
+		}
+		session, sock, _ := newTestSession(milter, 0, 0)
+		session.unfoldHeaders = unfoldHeaders
+		sock.send('L', cstrings("Received", folded))
+		session.HandleMilterCommands()
+
+		expected := folded
+		if unfoldHeaders {
+			expected = "from mx.example.com by mail.example.org; Tue, 13 Oct 2026 10:00:00 +0000"
+		}
+		if value != expected || raw != folded {
+			t.Errorf("Unfold %v: got value %q and raw value %q", unfoldHeaders, value, raw)
+		}
+	}
+}
+
+func TestRecoverPerCommand(t *testing.T) {
+	var reported []error
+	milter := &hookMilter{
+		mailFrom: func(from string, args []string, m *Modifier) (Response, error) {
+			if from == "bad@example.com" {
+				panic("mail handler failed")
+			}
+			return RespContinue, nil
+		},
+	}
+	session, sock, logger := newTestSession(milter, 0, 0)
+	session.recoverPerCommand = true
+	session.errHandlers = []func(error){func(err error) { reported = append(reported, err) }}
+	sock.send('M', cstrings("<bad@example.com>"))
+	sock.send('A', nil)
+	sock.send('M', cstrings("<good@example.com>"))
+	sock.send('E', nil)
+	session.HandleMilterCommands()
+
+	if codes := sock.codes(t); codes != "tca" {
+		t.Errorf("Expected tempfail for the panicking message only, got %q", codes)
+	}
+	if len(reported) != 1 || reported[0].Error() != "mail handler failed" {
+		t.Errorf("Expected panic to be reported once, got %v", reported)
+	}
+	if !logger.contains("goroutine") {
+		t.Error("Expected panic to be logged with stack")
+	}
+}
+
+func TestAutoProgress(t *testing.T) {
+	milter := &hookMilter{
+		body: func(m *Modifier) (Response, error) {
+			time.Sleep(100 * time.Millisecond)
+			return RespAccept, nil
+		},
+	}
+	session, sock, _ := newTestSession(milter, 0, 0)
+	session.autoProgressInterval = 10 * time.Millisecond
+	sock.send('M', cstrings("<from@example.com>"))
+	sock.send('E', nil)
+	session.HandleMilterCommands()
+
+	codes := sock.codes(t)
+	if !strings.HasPrefix(codes, "cp") || !strings.HasSuffix(codes, "pa") || strings.Trim(codes[1:len(codes)-1], "p") != "" {
+		t.Errorf("Expected progress reports before the reply to the slow command only, got %q", codes)
+	}
+}
+
+func TestEmptyBodyChunks(t *testing.T) {
+	for _, deliver := range []bool{false, true} {
+		var chunks []string
+		var size int64
+		milter := &hookMilter{
+			bodyChunk: func(chunk []byte, m *Modifier) (Response, error) {
+				chunks = append(chunks, string(chunk))
+				return RespContinue, nil
+			},
+			body: func(m *Modifier) (Response, error) {
+				size = m.BodySize()
+				body, _ := ioutil.ReadAll(m.BodyReader())
+				if string(body) != "firstsecond" {
+					t.Errorf("Deliver %v: got body %q", deliver, body)
+				}
+				return RespAccept, nil
+			},
+		}
+		session, sock, _ := newTestSession(milter, 0, 0)
+		session.bufferBody = true
+		session.deliverEmptyChunks = deliver
+		sock.send('B', []byte("first"))
+		sock.send('B', nil)
+		sock.send('B', []byte("second"))
+		sock.send('E', nil)
+		session.HandleMilterCommands()
+
+		expected := []string{"first", "second"}
+		if deliver {
+			expected = []string{"first", "", "second"}
+		}
+		if !reflect.DeepEqual(chunks, expected) {
+			t.Errorf("Deliver %v: got chunks %q, expected %q", deliver, chunks, expected)
+		}
+		if codes := sock.codes(t); codes != "ccca" || size != 11 {
+			t.Errorf("Deliver %v: got replies %q and body size %d", deliver, codes, size)
+		}
+	}
+}
+
+func TestQuitNewConnection(t *testing.T) {
+	var hosts []string
+	milter := &hookMilter{
+		helo: func(name string, m *Modifier) (Response, error) {
+			value, _ := m.Macro("j")
+			hosts = append(hosts, m.ConnectHost()+" "+value)
+			return RespContinue, nil
+		},
+	}
+	session, sock, _ := newTestSession(milter, 0, 0)
+	sock.send('O', optneg(6, OptAllActions, 0))
+	sock.send('D', append([]byte{'C'}, cstrings("j", "mx.example.com")...))
+	sock.send('C', connectData("first.example.com", '4', 25, "192.0.2.1"))
+	sock.send('H', cstrings("first.example.com"))
+	sock.send('K', nil)
+	sock.send('C', connectData("second.example.com", '4', 25, "192.0.2.2"))
+	sock.send('H', cstrings("second.example.com"))
+	sock.send('Q', nil)
+	session.HandleMilterCommands()
+
+	if codes := sock.codes(t); codes != "Occcc" {
+		t.Errorf("Expected no reply to quit, got %q", codes)
+	}
+	expected := []string{
+		"NewSession", "Connect", "Helo", "EndSession",
+		"NewSession", "Connect", "Helo", "EndSession",
+	}
+	if !reflect.DeepEqual(milter.calls, expected) {
+		t.Errorf("Got calls %v, expected %v", milter.calls, expected)
+	}
+	if expected := []string{"first.example.com mx.example.com", "second.example.com "}; !reflect.DeepEqual(hosts, expected) {
+		t.Errorf("Expected session state to be reset, got %q", hosts)
+	}
+}
+
+func TestQuitNewConnectionSessionID(t *testing.T) {
+	var ids []string
+	milter := &hookMilter{
+		mailFrom: func(from string, args []string, m *Modifier) (Response, error) {
+			ids = append(ids, m.SessionID())
+			return RespContinue, nil
+		},
+	}
+	session, sock, _ := newTestSession(milter, 0, 0)
+	n := 0
+	session.newSessionID = func() string {
+		n++
+		return fmt.Sprint("session-", n)
+	}
+	session.sessionID = session.newSessionID()
+	sock.send('M', cstrings("<from@example.com>"))
+	sock.send('M', cstrings("<from@example.com>"))
+	sock.send('K', nil)
+	sock.send('M', cstrings("<from@example.com>"))
+	session.HandleMilterCommands()
+
+	if expected := []string{"session-1", "session-1", "session-2"}; !reflect.DeepEqual(ids, expected) {
+		t.Errorf("Got session IDs %q, expected %q", ids, expected)
+	}
+	if session.messages != 1 || session.earlierMessages != 2 {
+		t.Errorf("Expected one message in the second session after two, got %d and %d", session.messages, session.earlierMessages)
+	}
+}
@@ -0,0 +1,45 @@
+package milter
+
+import (
+	"fmt"
+)
+
+// Stage identifies the part of the SMTP transaction a session is processing
+type Stage int
+
+// Define protocol stages in the order they occur
+const (
+	StageNone     Stage = iota // before the first SMTP command
+	StageConnect               // SMFIC_CONNECT
+	StageHelo                  // SMFIC_HELO
+	StageMailFrom              // SMFIC_MAIL
+	StageRcptTo                // SMFIC_RCPT
+	StageData                  // SMFIC_DATA
+	StageHeader                // SMFIC_HEADER
+	StageEOH                   // SMFIC_EOH
+	StageBody                  // SMFIC_BODY
+	StageEOM                   // SMFIC_BODYEOB
+	StageUnknown               // SMFIC_UNKNOWN
+)
+
+var stageNames = [...]string{
+	StageNone:     "none",
+	StageConnect:  "connect",
+	StageHelo:     "helo",
+	StageMailFrom: "mailfrom",
+	StageRcptTo:   "rcptto",
+	StageData:     "data",
+	StageHeader:   "header",
+	StageEOH:      "eoh",
+	StageBody:     "body",
+	StageEOM:      "eom",
+	StageUnknown:  "unknown",
+}
+
+// String returns the lower case stage name
+func (s Stage) String() string {
+	if s < 0 || int(s) >= len(stageNames) {
+		return fmt.Sprintf("Stage(%d)", int(s))
+	}
+	return stageNames[s]
+}
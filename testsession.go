@@ -0,0 +1,130 @@
+package milter
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+)
+
+// TestSession feeds SMTP transaction commands to a milter as the MTA would, it is
+// meant for testing Milter implementations without a socket. Each command returns
+// the milter's response, modifications are collected for Modifications
+type TestSession struct {
+	session *milterSession
+	sock    *testSock
+	started bool
+}
+
+// testSock collects the packets written by the session
+type testSock struct {
+	bytes.Buffer
+}
+
+func (s *testSock) Close() error { return nil }
+
+// NewTestSession creates a session for m as if actions and protocol were returned by
+// its MilterInit and accepted by the MTA
+func NewTestSession(m Milter, actions OptAction, protocol OptProtocol) *TestSession {
+	sock := &testSock{}
+	return &TestSession{
+		session: &milterSession{
+			actions:     actions,
+			protocol:    protocol,
+			mtaActions:  actions,
+			mtaProtocol: protocol,
+			version:     maxProtocolVersion,
+			sock:        sock,
+			milter:      m,
+			logger:      NopLogger,
+		},
+		sock: sock,
+	}
+}
+
+// process sends a command to the milter, the session starts with the first one
+func (t *TestSession) process(code byte, data []byte) (Response, error) {
+	if !t.started {
+		t.started = true
+		t.session.milter.NewSession(t.session.logger)
+	}
+	return t.session.Process(&Message{code, data})
+}
+
+// Macros defines macros for the command code, given as name and value pairs
+func (t *TestSession) Macros(code byte, macros ...string) error {
+	_, err := t.process('D', append([]byte{code}, encodeCStrings(macros...)...))
+	return err
+}
+
+// Connect sends SMFIC_CONNECT, family is one of the values passed to Milter.Connect
+func (t *TestSession) Connect(host string, family string, port uint16, addr net.IP) (Response, error) {
+	codes := map[string]byte{"tcp4": '4', "tcp6": '6', "unix": 'L'}
+	code, ok := codes[family]
+	if !ok {
+		return t.process('C', append(encodeCStrings(host), 'U'))
+	}
+	data := append(encodeCStrings(host), code, byte(port>>8), byte(port))
+	address := ""
+	if addr != nil {
+		address = addr.String()
+	}
+	return t.process('C', append(data, encodeCStrings(address)...))
+}
+
+// Helo sends SMFIC_HELO
+func (t *TestSession) Helo(name string) (Response, error) {
+	return t.process('H', encodeCStrings(name))
+}
+
+// MailFrom sends SMFIC_MAIL with the ESMTP arguments
+func (t *TestSession) MailFrom(from string, esmtpArgs ...string) (Response, error) {
+	return t.process('M', encodeCStrings(append([]string{"<" + from + ">"}, esmtpArgs...)...))
+}
+
+// RcptTo sends SMFIC_RCPT with the ESMTP arguments
+func (t *TestSession) RcptTo(rcptTo string, esmtpArgs ...string) (Response, error) {
+	return t.process('R', encodeCStrings(append([]string{"<" + rcptTo + ">"}, esmtpArgs...)...))
+}
+
+// Header sends SMFIC_HEADER
+func (t *TestSession) Header(name, value string) (Response, error) {
+	return t.process('L', encodeCStrings(name, value))
+}
+
+// EndOfHeaders sends SMFIC_EOH
+func (t *TestSession) EndOfHeaders() (Response, error) {
+	return t.process('N', nil)
+}
+
+// BodyChunk sends SMFIC_BODY
+func (t *TestSession) BodyChunk(chunk []byte) (Response, error) {
+	return t.process('B', chunk)
+}
+
+// EndOfBody sends SMFIC_BODYEOB
+func (t *TestSession) EndOfBody() (Response, error) {
+	return t.process('E', nil)
+}
+
+// Modifications returns the packets the milter sent since the last call, such as
+// added headers ('h') or a replaced body ('b')
+func (t *TestSession) Modifications() []*Message {
+	var messages []*Message
+	for t.sock.Len() >= 5 {
+		length := binary.BigEndian.Uint32(t.sock.Next(4))
+		data := make([]byte, length)
+		if _, err := io.ReadFull(t.sock, data); err != nil {
+			break
+		}
+		messages = append(messages, &Message{data[0], data[1:]})
+	}
+	return messages
+}
+
+// Close ends the session
+func (t *TestSession) Close() {
+	if t.started {
+		t.session.milter.EndSession()
+	}
+}
@@ -0,0 +1,70 @@
+package milter
+
+import (
+	"net"
+	"net/textproto"
+	"reflect"
+	"testing"
+)
+
+func TestTestSession(t *testing.T) {
+	milter := &hookMilter{
+		rcptTo: func(rcpt string, args []string, m *Modifier) (Response, error) {
+			if rcpt == "spam@example.com" {
+				return RespReject, nil
+			}
+			return RespContinue, nil
+		},
+		headers: func(h textproto.MIMEHeader, m *Modifier) (Response, error) {
+			return RespContinue, m.AddHeader("X-Checked", h.Get("Subject"))
+		},
+		body: func(m *Modifier) (Response, error) {
+			queueID, _ := m.Macro("i")
+			return RespAccept, m.AddHeader("X-Queue-ID", queueID)
+		},
+	}
+	s := NewTestSession(milter, OptAddHeader, 0)
+	steps := []struct {
+		name string
+		call func() (Response, error)
+		code byte
+	}{
+		{"Connect", func() (Response, error) {
+			return s.Connect("mx.example.com", "tcp4", 25, net.ParseIP("192.0.2.1"))
+		}, continue_},
+		{"Helo", func() (Response, error) { return s.Helo("mx.example.com") }, continue_},
+		{"MailFrom", func() (Response, error) { return s.MailFrom("from@example.com", "SIZE=100") }, continue_},
+		{"RcptTo", func() (Response, error) { return s.RcptTo("spam@example.com") }, reject},
+		{"RcptTo", func() (Response, error) { return s.RcptTo("to@example.com") }, continue_},
+		{"Header", func() (Response, error) { return s.Header("Subject", "Hello") }, continue_},
+		{"EndOfHeaders", s.EndOfHeaders, continue_},
+		{"BodyChunk", func() (Response, error) { return s.BodyChunk([]byte("body")) }, continue_},
+		{"EndOfBody", func() (Response, error) {
+			if err := s.Macros('E', "i", "4AB1C2"); err != nil {
+				return nil, err
+			}
+			return s.EndOfBody()
+		}, accept},
+	}
+	for _, step := range steps {
+		resp, err := step.call()
+		if err != nil || resp.Response().Code != step.code {
+			t.Errorf("%s: expected %c, got %v %v", step.name, step.code, resp, err)
+		}
+	}
+	s.Close()
+
+	var headers []string
+	for _, msg := range s.Modifications() {
+		headers = append(headers, string(msg.Code)+string(msg.Data))
+	}
+	if expected := []string{"hX-Checked\x00Hello\x00", "hX-Queue-ID\x004AB1C2\x00"}; !reflect.DeepEqual(headers, expected) {
+		t.Errorf("Got modifications %q, expected %q", headers, expected)
+	}
+	if len(s.Modifications()) != 0 {
+		t.Error("Expected modifications to be returned once")
+	}
+	if milter.calls[0] != "NewSession" || milter.calls[len(milter.calls)-1] != "EndSession" {
+		t.Errorf("Got calls %v", milter.calls)
+	}
+}